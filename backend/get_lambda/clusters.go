@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Above this zoom level every task is returned individually
+const clusterMaxZoom = 15
+
+// Grid cells per 256px map tile, so clusters end up roughly 64px apart
+const clusterCellsPerTile = 4
+
+const maxClusterResults = 1000
+
+type TaskCluster struct {
+	Count   int     `json:"count"`
+	Lat     float64 `json:"lat"`
+	Lng     float64 `json:"lng"`
+	TopTask TaskRet `json:"top_task"`
+}
+
+type ClusterRet struct {
+	Clusters []TaskCluster `json:"clusters"`
+	// Tasks that ended up alone in their cell
+	Tasks []TaskRet `json:"tasks"`
+}
+
+// Size in degrees of a clustering grid cell at the given zoom level
+func clusterCellSize(zoom int) float64 {
+	if zoom > clusterMaxZoom {
+		return 0
+	}
+
+	return 360 / (math.Pow(2, float64(zoom)) * clusterCellsPerTile)
+}
+
+func getTaskClusters(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if res := requireParameters(request, "min_lat", "min_lng", "max_lat", "max_lng", "zoom"); res != nil {
+		return *res
+	}
+
+	zoom, err := strconv.Atoi(request.QueryStringParameters["zoom"])
+	if err != nil || zoom < 0 || zoom > 22 {
+		return *invalidParameterResponse("zoom (must be between 0 and 22)")
+	}
+
+	// The map only shows tasks that can still be done unless told otherwise
+	if _, exists := request.QueryStringParameters["status"]; !exists {
+		params := map[string]string{"status": "active,upcoming"}
+		for key, value := range request.QueryStringParameters {
+			params[key] = value
+		}
+		request.QueryStringParameters = params
+	}
+
+	query, res := buildTaskQuery(request)
+	if res != nil {
+		return *res
+	}
+
+	distance_select := "NULL::double precision"
+	if query.Distance != "" {
+		distance_select = query.Distance
+	}
+
+	// Bucket tasks into grid cells and keep the most liked task of each cell
+	// alongside the cell's size and centroid. A cell size of zero leaves
+	// every distinct location in its own cell
+	cell_size := query.arg(clusterCellSize(zoom))
+	rows, err := dbConn.Query(context.Background(), fmt.Sprintf(`
+		SELECT id, title, location_name, location_address,
+			description, lat, lng, uploaded,
+			start, stop, initial_img_id, likes,
+			rrule, duration, time_zone, num_comments, top_img_id,
+			distance, count, center_lat, center_lng
+			FROM (
+				SELECT *,
+					%s AS distance,
+					count(*) OVER cell AS count,
+					avg(lat) OVER cell AS center_lat,
+					avg(lng) OVER cell AS center_lng,
+					row_number() OVER (cell ORDER BY likes DESC, id DESC) AS cell_rank
+					FROM task
+					WHERE NOT hidden AND %s
+					WINDOW cell AS (PARTITION BY ST_SnapToGrid(location::geometry, %s))
+			) cells
+			WHERE cell_rank = 1
+			ORDER BY count DESC, likes DESC
+			LIMIT %s
+	`, distance_select, strings.Join(query.Where, " AND "), cell_size, query.arg(maxClusterResults)), query.Args...)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+	defer rows.Close()
+
+	occurrences_from, occurrences_to := getOccurrenceRange(request)
+	clusters := ClusterRet{
+		Clusters: []TaskCluster{},
+		Tasks:    []TaskRet{},
+	}
+	for rows.Next() {
+		var cluster TaskCluster
+		var task_distance *float64
+		task, res := parseTask(rows, &task_distance, &cluster.Count, &cluster.Lat, &cluster.Lng)
+		if res != nil {
+			return *res
+		}
+		task.Distance = task_distance
+		expandOccurrences(&task, occurrences_from, occurrences_to)
+
+		if cluster.Count == 1 {
+			clusters.Tasks = append(clusters.Tasks, task)
+		} else {
+			cluster.TopTask = task
+			clusters.Clusters = append(clusters.Clusters, cluster)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	clusters_json, err := json.Marshal(clusters)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("JSON marshalling error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       string(clusters_json),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
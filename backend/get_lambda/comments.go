@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Comments read oldest first like a conversation
+var commentSort = taskSort{Name: "created:asc", Expr: "created", Type: "timestamptz"}
+
+type CommentRet struct {
+	Id       int  `json:"id"`
+	TaskId   *int `json:"task_id"`
+	ImgId    *int `json:"img_id"`
+	ParentId *int `json:"parent_id"`
+	// Authors are device ids, so only tell callers whether it was them
+	Mine       bool   `json:"mine"`
+	Body       string `json:"body"`
+	Created    int64  `json:"created"`
+	Deleted    bool   `json:"deleted"`
+	NumReplies int    `json:"num_replies"`
+}
+
+type CommentPage struct {
+	Comments   []CommentRet `json:"comments"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// List the comments on a task or image. Without parent_id only top level
+// comments are listed, replies are fetched per comment with parent_id.
+// Hidden comments are listed like deleted ones to keep threads intact
+func getComments(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	params := request.QueryStringParameters
+	query := taskQuery{}
+
+	target := 0
+	for _, name := range []string{"task_id", "img_id", "parent_id"} {
+		id_str, exists := params[name]
+		if !exists {
+			continue
+		}
+
+		id, err := strconv.Atoi(id_str)
+		if err != nil {
+			return *invalidParameterResponse(name)
+		}
+		query.Where = append(query.Where, fmt.Sprintf("%s = %s", name, query.arg(id)))
+		target++
+	}
+	if target == 0 {
+		return *invalidParameterResponse("task_id, img_id or parent_id")
+	}
+
+	if _, exists := params["parent_id"]; !exists {
+		query.Where = append(query.Where, "parent_id IS NULL")
+		// Task threads don't include the threads of its images
+		if _, exists := params["img_id"]; !exists {
+			query.Where = append(query.Where, "img_id IS NULL")
+		}
+	}
+
+	// Threads of hidden tasks and images are hidden with them
+	query.Where = append(query.Where,
+		"NOT coalesce((SELECT hidden FROM task WHERE task.id = comment.task_id), false)",
+		"NOT coalesce((SELECT hidden FROM img WHERE img.id = comment.img_id), false)")
+
+	limit, cursor, res := getPaginationParameters(request, commentSort)
+	if res != nil {
+		return *res
+	}
+	if cursor != nil {
+		query.Where = append(query.Where, fmt.Sprintf("(created, id) > (%s::text::timestamptz, %s)",
+			query.arg(cursor.SortKey), query.arg(cursor.Id)))
+	}
+
+	// Fetch one extra row to know whether another page exists
+	rows, err := dbConn.Query(context.Background(), fmt.Sprintf(`
+		SELECT id, task_id, img_id, parent_id, author,
+			CASE WHEN hidden THEN '' ELSE body END, created, deleted OR hidden,
+			(SELECT count(*) FROM comment reply
+				WHERE reply.parent_id = comment.id AND NOT reply.deleted AND NOT reply.hidden),
+			created::text
+			FROM comment
+			WHERE %s
+			ORDER BY created, id
+			LIMIT %s
+	`, strings.Join(query.Where, " AND "), query.arg(limit+1)), query.Args...)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+	defer rows.Close()
+
+	user := getRequestUser(request)
+	page := CommentPage{
+		Comments: []CommentRet{},
+	}
+	var last_sort_key string
+	for rows.Next() {
+		var comment CommentRet
+		var author string
+		var created time.Time
+		var sort_key string
+		err := rows.Scan(&comment.Id, &comment.TaskId, &comment.ImgId, &comment.ParentId,
+			&author, &comment.Body, &created, &comment.Deleted, &comment.NumReplies, &sort_key)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       fmt.Sprintf("Database error: %v", err),
+				Headers: map[string]string{
+					"Content-Type": "text/plain",
+				},
+			}
+		}
+		comment.Created = created.Unix()
+		comment.Mine = user != "" && author == user
+
+		if len(page.Comments) == limit {
+			page.NextCursor = encodeCursor(pageCursor{
+				Sort:    commentSort.Name,
+				SortKey: last_sort_key,
+				Id:      page.Comments[limit-1].Id,
+			})
+			break
+		}
+
+		page.Comments = append(page.Comments, comment)
+		last_sort_key = sort_key
+	}
+	if err := rows.Err(); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	page_json, err := json.Marshal(page)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("JSON marshalling error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       string(page_json),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
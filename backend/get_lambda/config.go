@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/joho/godotenv"
+)
+
+// Presigned S3 links can't outlive a week
+const maxPresignTTL = 7 * 24 * time.Hour
+
+// Optional parts of the API that can be switched off without a deploy of
+// new code
+type FeatureFlags struct {
+	GeocodeCache bool
+	RateLimit    bool
+	// Places autocomplete and details, off until the frontend searches
+	// places through them
+	PlacesProxy bool
+	Exports     bool
+}
+
+// Everything the Lambda reads from its environment. The Lambdas share one
+// environment, so the same name means the same thing in each of them
+type Config struct {
+	DatabaseURL      string
+	DBMaxConns       int
+	DBConnectTimeout time.Duration
+
+	GoogleMapsKey        string
+	GoogleMapsBrowserKey string
+
+	// Signs the tokens of liked calendar feeds, which are off without it
+	CalendarFeedSecret string
+
+	S3Region           string
+	AWSAccessKeyId     string
+	AWSSecretAccessKey string
+	ImageBucket        string
+	ImageURLTTL        time.Duration
+
+	// Origins allowed to call the API from a browser, "*" for any
+	CORSOrigins []string
+	LocalMode   bool
+	// Address of the local server, which runs instead of the Lambda runtime
+	// in local mode
+	LocalAddr string
+	LogLevel  slog.Level
+	Features  FeatureFlags
+}
+
+var config Config
+
+// Reads variables and collects every problem with them instead of stopping
+// at the first
+type configLoader struct {
+	problems []string
+}
+
+func (l *configLoader) problem(name string, format string, args ...interface{}) {
+	l.problems = append(l.problems, fmt.Sprintf("%s: %s", name, fmt.Sprintf(format, args...)))
+}
+
+func (l *configLoader) string(name string, fallback string) string {
+	if value := strings.TrimSpace(os.Getenv(name)); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func (l *configLoader) required(name string) string {
+	value := l.string(name, "")
+	if value == "" {
+		l.problem(name, "required")
+	}
+	return value
+}
+
+func (l *configLoader) positiveInt(name string, fallback int) int {
+	value_str := l.string(name, "")
+	if value_str == "" {
+		return fallback
+	}
+
+	value, err := strconv.Atoi(value_str)
+	if err != nil || value <= 0 {
+		l.problem(name, "must be a positive integer, got %q", value_str)
+		return fallback
+	}
+	return value
+}
+
+// Go duration like "15m" or "168h", at most max when max isn't 0
+func (l *configLoader) duration(name string, fallback time.Duration, max time.Duration) time.Duration {
+	value_str := l.string(name, "")
+	if value_str == "" {
+		return fallback
+	}
+
+	value, err := time.ParseDuration(value_str)
+	if err != nil || value <= 0 {
+		l.problem(name, "must be a positive duration like 15m or 24h, got %q", value_str)
+		return fallback
+	}
+	if max != 0 && value > max {
+		l.problem(name, "must be at most %v, got %v", max, value)
+		return fallback
+	}
+	return value
+}
+
+func (l *configLoader) flag(name string, fallback bool) bool {
+	value_str := l.string(name, "")
+	if value_str == "" {
+		return fallback
+	}
+
+	value, err := strconv.ParseBool(value_str)
+	if err != nil {
+		l.problem(name, "must be true or false, got %q", value_str)
+		return fallback
+	}
+	return value
+}
+
+// debug, info, warn or error
+func (l *configLoader) level(name string, fallback slog.Level) slog.Level {
+	value_str := l.string(name, "")
+	if value_str == "" {
+		return fallback
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value_str)); err != nil {
+		l.problem(name, "must be debug, info, warn or error, got %q", value_str)
+		return fallback
+	}
+	return level
+}
+
+// Comma separated, empty items dropped
+func (l *configLoader) list(name string, fallback []string) []string {
+	value_str := l.string(name, "")
+	if value_str == "" {
+		return fallback
+	}
+
+	values := []string{}
+	for _, value := range strings.Split(value_str, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func (l *configLoader) origins(name string, fallback []string) []string {
+	origins := l.list(name, fallback)
+	for _, origin := range origins {
+		if origin == "*" {
+			continue
+		}
+		parsed, err := url.Parse(origin)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" ||
+			(parsed.Path != "" && parsed.Path != "/") {
+			l.problem(name, "%q is not an origin like https://example.com", origin)
+		}
+	}
+	return origins
+}
+
+// Load the configuration from the environment, then .env in the working
+// directory, then the dotenv file named by CONFIG_FILE, earlier sources
+// winning. Returns every invalid or missing setting at once
+func loadConfig() (Config, error) {
+	l := &configLoader{}
+
+	if err := godotenv.Load(); err != nil {
+		fmt.Println("Error loading .env file, proceeding without it...")
+	}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := godotenv.Load(path); err != nil {
+			l.problem("CONFIG_FILE", "%v", err)
+		}
+	}
+
+	config := Config{
+		DatabaseURL:      l.required("DATABASE_URL"),
+		DBMaxConns:       l.positiveInt("DB_MAX_CONNS", 32),
+		DBConnectTimeout: l.duration("DB_CONNECT_TIMEOUT", 10*time.Second, 0),
+
+		GoogleMapsKey:        l.required("GOOGLE_MAPS_KEY"),
+		GoogleMapsBrowserKey: l.string("GOOGLE_MAPS_BROWSER_KEY", ""),
+
+		CalendarFeedSecret: l.string("CALENDAR_FEED_SECRET", ""),
+
+		S3Region:           l.required("S3_REGION"),
+		AWSAccessKeyId:     l.string("AWS_ACCESS_KEY_ID", ""),
+		AWSSecretAccessKey: l.string("AWS_SECRET_ACCESS_KEY", ""),
+		ImageBucket:        l.string("IMAGE_BUCKET", "spontaniapp-imgs"),
+		ImageURLTTL:        l.duration("IMAGE_URL_TTL", maxPresignTTL, maxPresignTTL),
+
+		CORSOrigins: l.origins("CORS_ORIGINS", []string{"*"}),
+		LocalMode:   l.flag("LOCAL_MODE", false),
+		LocalAddr:   l.string("LOCAL_ADDR", ":8081"),
+		LogLevel:    l.level("LOG_LEVEL", slog.LevelInfo),
+		Features: FeatureFlags{
+			GeocodeCache: l.flag("FEATURE_GEOCODE_CACHE", true),
+			RateLimit:    l.flag("FEATURE_RATE_LIMIT", true),
+			PlacesProxy:  l.flag("FEATURE_PLACES_PROXY", false),
+			Exports:      l.flag("FEATURE_EXPORTS", true),
+		},
+	}
+
+	if config.DatabaseURL != "" {
+		// The error never contains the password
+		if _, err := pgxpool.ParseConfig(config.DatabaseURL); err != nil {
+			l.problem("DATABASE_URL", "%v", err)
+		}
+	}
+	if (config.AWSAccessKeyId == "") != (config.AWSSecretAccessKey == "") {
+		l.problem("AWS_ACCESS_KEY_ID", "must be set together with AWS_SECRET_ACCESS_KEY")
+	}
+	if config.GoogleMapsBrowserKey != "" && config.GoogleMapsBrowserKey == config.GoogleMapsKey {
+		l.problem("GOOGLE_MAPS_BROWSER_KEY", "must be a separate, restricted key, not GOOGLE_MAPS_KEY")
+	}
+
+	if len(l.problems) > 0 {
+		return config, fmt.Errorf("invalid configuration:\n\t%s", strings.Join(l.problems, "\n\t"))
+	}
+	return config, nil
+}
+
+// Values that must never show up in the logs, whatever attribute they end
+// up in
+func (c Config) secrets() []string {
+	secrets := []string{c.DatabaseURL, c.GoogleMapsKey, c.CalendarFeedSecret, c.AWSSecretAccessKey}
+	if pgx_config, err := pgxpool.ParseConfig(c.DatabaseURL); err == nil {
+		secrets = append(secrets, pgx_config.ConnConfig.Password)
+	}
+
+	return secrets
+}
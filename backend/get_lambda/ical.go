@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const icalProductId = "-//spontaniapp//tasks//EN"
+
+const maxCalendarEvents = 500
+
+// Nearby feeds cover this radius unless the request gives one
+const defaultCalendarRadiusKm = "25"
+
+// Escape a TEXT value, RFC 5545 section 3.3.11
+func escapeICalText(value string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(value)
+}
+
+// Fold a content line into 75 octet pieces without splitting UTF-8
+// sequences, RFC 5545 section 3.1
+func foldICalLine(line string) string {
+	var folded strings.Builder
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		folded.WriteString(line[:cut])
+		folded.WriteString("\r\n ")
+		line = line[cut:]
+		// Continuation lines lose one octet to the leading space
+		limit = 74
+	}
+	folded.WriteString(line)
+	folded.WriteString("\r\n")
+
+	return folded.String()
+}
+
+func formatICalTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// Wall clock time in location, for properties with a TZID
+func formatICalLocalTime(t time.Time, location *time.Location) string {
+	return t.In(location).Format("20060102T150405")
+}
+
+func formatICalOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign, offset = "-", -offset
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset/60%60)
+}
+
+// Write a VTIMEZONE for location covering [from, to], with one observance
+// per offset change found in that range, RFC 5545 section 3.6.5
+func writeICalTimeZone(calendar *strings.Builder, location *time.Location, from time.Time, to time.Time) {
+	observance := func(onset time.Time, offset_from int) {
+		name, offset := onset.In(location).Zone()
+		kind := "STANDARD"
+		if onset.In(location).IsDST() {
+			kind = "DAYLIGHT"
+		}
+		// Onsets are given in the wall clock time before the change
+		local_onset := onset.UTC().Add(time.Duration(offset_from) * time.Second)
+		for _, line := range []string{
+			"BEGIN:" + kind,
+			"DTSTART:" + local_onset.Format("20060102T150405"),
+			"TZOFFSETFROM:" + formatICalOffset(offset_from),
+			"TZOFFSETTO:" + formatICalOffset(offset),
+			"TZNAME:" + escapeICalText(name),
+			"END:" + kind,
+		} {
+			calendar.WriteString(foldICalLine(line))
+		}
+	}
+
+	calendar.WriteString(foldICalLine("BEGIN:VTIMEZONE"))
+	calendar.WriteString(foldICalLine("TZID:" + location.String()))
+
+	// Step through the range a day at a time and narrow each change of
+	// offset down to the second
+	t := from.Add(-24 * time.Hour)
+	_, offset := t.In(location).Zone()
+	observance(t, offset)
+	for t.Before(to) {
+		next := t.Add(24 * time.Hour)
+		if _, next_offset := next.In(location).Zone(); next_offset != offset {
+			low, high := t, next
+			for high.Sub(low) > time.Second {
+				middle := low.Add(high.Sub(low) / 2)
+				if _, middle_offset := middle.In(location).Zone(); middle_offset == offset {
+					low = middle
+				} else {
+					high = middle
+				}
+			}
+			observance(high, offset)
+			_, offset = high.In(location).Zone()
+		}
+		t = next
+	}
+
+	calendar.WriteString(foldICalLine("END:VTIMEZONE"))
+}
+
+// Liked feeds are subscribed to by calendar clients, which can't send
+// headers. Their token names the user and is signed with
+// CALENDAR_FEED_SECRET so it can't be made up
+func calendarToken(user string) string {
+	mac := hmac.New(sha256.New, []byte(config.CalendarFeedSecret))
+	mac.Write([]byte(user))
+	return base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// User named by a calendar token, empty when the token isn't valid
+func calendarTokenUser(token string) string {
+	if config.CalendarFeedSecret == "" {
+		return ""
+	}
+
+	user_part, _, found := strings.Cut(token, ".")
+	if !found {
+		return ""
+	}
+	user, err := base64.RawURLEncoding.DecodeString(user_part)
+	if err != nil || len(user) == 0 {
+		return ""
+	}
+	if !hmac.Equal([]byte(calendarToken(string(user))), []byte(token)) {
+		return ""
+	}
+
+	return string(user)
+}
+
+// Token for the caller's liked feed, to be put in the subscription URL
+func getCalendarToken(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if config.CalendarFeedSecret == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 503,
+			Body:       "Calendar feeds are not configured",
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	user := getRequestUser(request)
+	if user == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Missing user: send an X-Device-Id header",
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       calendarToken(user),
+		Headers: map[string]string{
+			"Content-Type": "text/plain",
+		},
+	}
+}
+
+// Write a task as a VEVENT. Recurring tasks keep their rule so calendars
+// expand the occurrences themselves, in the task's time zone so wall clock
+// times stay put across daylight saving changes. The calendar needs a
+// VTIMEZONE for that zone
+func writeICalEvent(calendar *strings.Builder, task TaskRet, now time.Time) {
+	start := time.Unix(task.Start, 0)
+	stop := time.Unix(task.Stop, 0)
+
+	lines := []string{
+		"BEGIN:VEVENT",
+		fmt.Sprintf("UID:task-%d@spontaniapp", task.Id),
+		"DTSTAMP:" + formatICalTime(now),
+	}
+
+	if task.RRule != "" {
+		rule := strings.TrimPrefix(task.RRule, "RRULE:")
+		if !strings.Contains(rule, "UNTIL=") && !strings.Contains(rule, "COUNT=") {
+			rule += ";UNTIL=" + formatICalTime(stop)
+		}
+		location := taskLocation(task.TimeZone)
+		occurrence_stop := start.Add(time.Duration(task.Duration) * time.Second)
+		if location == time.UTC {
+			lines = append(lines,
+				"DTSTART:"+formatICalTime(start),
+				"DTEND:"+formatICalTime(occurrence_stop),
+			)
+		} else {
+			lines = append(lines,
+				fmt.Sprintf("DTSTART;TZID=%s:%s", location, formatICalLocalTime(start, location)),
+				fmt.Sprintf("DTEND;TZID=%s:%s", location, formatICalLocalTime(occurrence_stop, location)),
+			)
+		}
+		lines = append(lines, "RRULE:"+rule)
+	} else {
+		lines = append(lines,
+			"DTSTART:"+formatICalTime(start),
+			"DTEND:"+formatICalTime(stop),
+		)
+	}
+
+	location := task.LocationName
+	if task.LocationAddress != "" {
+		location = fmt.Sprintf("%s, %s", task.LocationName, task.LocationAddress)
+	}
+
+	lines = append(lines,
+		"SUMMARY:"+escapeICalText(task.Title),
+		"DESCRIPTION:"+escapeICalText(task.Description),
+		"LOCATION:"+escapeICalText(location),
+		fmt.Sprintf("GEO:%f;%f", task.Lat, task.Lng),
+		"END:VEVENT",
+	)
+
+	for _, line := range lines {
+		calendar.WriteString(foldICalLine(line))
+	}
+}
+
+// Build an RFC 5545 feed for a single task, the tasks the caller liked or
+// the active tasks near a point
+func getCalendar(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	query := taskQuery{}
+	feed := request.QueryStringParameters["feed"]
+	switch feed {
+	case "task":
+		if res := requireParameters(request, "id"); res != nil {
+			return *res
+		}
+
+		id, err := strconv.Atoi(request.QueryStringParameters["id"])
+		if err != nil {
+			return *invalidParameterResponse("id")
+		}
+
+		query.Where = []string{fmt.Sprintf("id = %s", query.arg(id))}
+		query.Sort = taskSort{Name: "start:asc", Expr: "occurrence_start", Type: "timestamptz"}
+	case "liked":
+		user := getRequestUser(request)
+		if token, exists := request.QueryStringParameters["token"]; exists {
+			user = calendarTokenUser(token)
+			if user == "" {
+				return *invalidParameterResponse("token")
+			}
+		}
+		if user == "" {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       "Missing user: send an X-Device-Id header or a token from get_calendar_token",
+				Headers: map[string]string{
+					"Content-Type": "text/plain",
+				},
+			}
+		}
+
+		query.Where = []string{fmt.Sprintf("id IN (SELECT task_id FROM task_like WHERE user_id = %s)", query.arg(user))}
+		query.Sort = taskSort{Name: "start:asc", Expr: "occurrence_start", Type: "timestamptz"}
+	case "nearby":
+		if res := requireParameters(request, "lat", "lng"); res != nil {
+			return *res
+		}
+
+		fixed := map[string]string{
+			"status": "active",
+			"sort":   "distance",
+		}
+		if _, exists := request.QueryStringParameters["radius_km"]; !exists {
+			fixed["radius_km"] = defaultCalendarRadiusKm
+		}
+
+		var res *events.APIGatewayProxyResponse
+		query, res = buildTaskQuery(withParameters(request, fixed))
+		if res != nil {
+			return *res
+		}
+	default:
+		return *invalidParameterResponse("feed (must be task, liked or nearby)")
+	}
+
+	rows, err := queryTasks(query, nil, maxCalendarEvents)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+	defer rows.Close()
+
+	// Time zones have to be known before the events that use them
+	tasks := []TaskRet{}
+	for rows.Next() {
+		var distance *float64
+		var sort_key string
+		task, res := parseTask(rows, &distance, &sort_key)
+		if res != nil {
+			return *res
+		}
+
+		tasks = append(tasks, task)
+	}
+	if err := rows.Err(); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	// Range each zone's recurring tasks cover
+	type zoneRange struct {
+		location *time.Location
+		from, to time.Time
+	}
+	zones := map[string]*zoneRange{}
+	for _, task := range tasks {
+		location := taskLocation(task.TimeZone)
+		if task.RRule == "" || location == time.UTC {
+			continue
+		}
+		start, stop := time.Unix(task.Start, 0), time.Unix(task.Stop, 0)
+		zone, exists := zones[location.String()]
+		if !exists {
+			zones[location.String()] = &zoneRange{location, start, stop}
+			continue
+		}
+		if start.Before(zone.from) {
+			zone.from = start
+		}
+		if stop.After(zone.to) {
+			zone.to = stop
+		}
+	}
+	zone_names := []string{}
+	for name := range zones {
+		zone_names = append(zone_names, name)
+	}
+	sort.Strings(zone_names)
+
+	now := time.Now()
+	var calendar strings.Builder
+	calendar.WriteString(foldICalLine("BEGIN:VCALENDAR"))
+	calendar.WriteString(foldICalLine("VERSION:2.0"))
+	calendar.WriteString(foldICalLine("PRODID:" + icalProductId))
+	calendar.WriteString(foldICalLine("CALSCALE:GREGORIAN"))
+	calendar.WriteString(foldICalLine("METHOD:PUBLISH"))
+	calendar.WriteString(foldICalLine("X-WR-CALNAME:" + escapeICalText("spontani "+feed)))
+	for _, name := range zone_names {
+		writeICalTimeZone(&calendar, zones[name].location, zones[name].from, zones[name].to)
+	}
+	for _, task := range tasks {
+		writeICalEvent(&calendar, task, now)
+	}
+	calendar.WriteString(foldICalLine("END:VCALENDAR"))
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       calendar.String(),
+		Headers: map[string]string{
+			"Content-Type":        "text/calendar; charset=utf-8",
+			"Content-Disposition": fmt.Sprintf("inline; filename=\"spontani-%s.ics\"", feed),
+		},
+	}
+}
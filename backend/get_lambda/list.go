@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Sortable task columns with their SQL type and default direction
+var taskSortKeys = map[string]taskSort{
+	"likes":           {Expr: "likes", Type: "integer", Desc: true},
+	"num_submissions": {Expr: "num_submissions", Type: "integer", Desc: true},
+	"uploaded":        {Expr: "uploaded", Type: "timestamptz", Desc: true},
+	"start":           {Expr: "occurrence_start", Type: "timestamptz"},
+	"stop":            {Expr: "occurrence_stop", Type: "timestamptz"},
+}
+
+func invalidParameterResponse(name string) *events.APIGatewayProxyResponse {
+	return &events.APIGatewayProxyResponse{
+		StatusCode: 400,
+		Body:       fmt.Sprintf("Invalid parameters: %s", name),
+		Headers: map[string]string{
+			"Content-Type": "text/plain",
+		},
+	}
+}
+
+func requireParameters(request events.APIGatewayProxyRequest, names ...string) *events.APIGatewayProxyResponse {
+	for _, name := range names {
+		if _, exists := request.QueryStringParameters[name]; !exists {
+			return &events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf("Missing required parameters: %s", strings.Join(names, ", ")),
+				Headers: map[string]string{
+					"Content-Type": "text/plain",
+				},
+			}
+		}
+	}
+
+	return nil
+}
+
+// Translate the filter and sort parameters of a listing request into a
+// taskQuery. Every user supplied value is passed as a query argument, only
+// whitelisted column names are ever interpolated into the SQL
+func buildTaskQuery(request events.APIGatewayProxyRequest) (taskQuery, *events.APIGatewayProxyResponse) {
+	params := request.QueryStringParameters
+	query := taskQuery{}
+
+	// Point used for distance, either given directly or the bbox center.
+	// point_key identifies it in distance cursors
+	var point, point_key string
+	if _, lat_exists := params["lat"]; lat_exists {
+		lat, lng, res := getLatLngParameters(request)
+		if res != nil {
+			return query, res
+		}
+		point = fmt.Sprintf("ST_SetSRID(ST_MakePoint(%s, %s), 4326)::geography", query.arg(lng), query.arg(lat))
+		point_key = fmt.Sprintf("%g,%g", lat, lng)
+	}
+
+	if _, bbox_exists := params["min_lat"]; bbox_exists {
+		min_lat, min_lng, max_lat, max_lng, res := getBBoxParameters(request)
+		if res != nil {
+			return query, res
+		}
+		center_lng := (min_lng + max_lng) / 2
+		if min_lng <= max_lng {
+			query.Where = append(query.Where, fmt.Sprintf("location && ST_MakeEnvelope(%s, %s, %s, %s, 4326)::geography",
+				query.arg(min_lng), query.arg(min_lat), query.arg(max_lng), query.arg(max_lat)))
+		} else {
+			// Split a box crossing the antimeridian into its two halves
+			query.Where = append(query.Where, fmt.Sprintf(
+				"(location && ST_MakeEnvelope(%s, %s, 180, %s, 4326)::geography OR location && ST_MakeEnvelope(-180, %s, %s, %s, 4326)::geography)",
+				query.arg(min_lng), query.arg(min_lat), query.arg(max_lat), query.arg(min_lat), query.arg(max_lng), query.arg(max_lat)))
+			center_lng += 180
+			if center_lng > 180 {
+				center_lng -= 360
+			}
+		}
+
+		if point == "" {
+			center_lat := (min_lat + max_lat) / 2
+			point = fmt.Sprintf("ST_SetSRID(ST_MakePoint(%s, %s), 4326)::geography",
+				query.arg(center_lng), query.arg(center_lat))
+			point_key = fmt.Sprintf("%g,%g", center_lat, center_lng)
+		}
+	}
+
+	if point != "" {
+		query.Distance = fmt.Sprintf("ST_Distance(location, %s)", point)
+	}
+
+	if radius_str, exists := params["radius_km"]; exists {
+		radius_km, err := strconv.ParseFloat(radius_str, 64)
+		if err != nil || radius_km <= 0 || radius_km > 500 {
+			return query, invalidParameterResponse("radius_km (must be between 0 and 500)")
+		}
+		if point == "" {
+			return query, invalidParameterResponse("radius_km (requires lat, lng)")
+		}
+		query.Where = append(query.Where, fmt.Sprintf("ST_DWithin(location, %s, %s)", point, query.arg(radius_km*1000)))
+	}
+
+	// Recurring tasks are filtered and sorted by their current occurrence
+	if status_str, exists := params["status"]; exists {
+		now := query.arg(time.Now())
+		conditions := []string{}
+		for _, status := range strings.Split(status_str, ",") {
+			switch status {
+			case "active":
+				conditions = append(conditions, fmt.Sprintf("(occurrence_start < %s AND occurrence_stop > %s)", now, now))
+			case "ending_soon":
+				conditions = append(conditions, fmt.Sprintf("(occurrence_start < %s AND occurrence_stop > %s AND occurrence_stop <= %s)",
+					now, now, query.arg(time.Now().Add(endingSoonWindow))))
+			case "upcoming":
+				conditions = append(conditions, fmt.Sprintf("occurrence_start >= %s", now))
+			case "completed":
+				conditions = append(conditions, fmt.Sprintf("occurrence_stop <= %s", now))
+			default:
+				return query, invalidParameterResponse("status (must be active, ending_soon, upcoming or completed)")
+			}
+		}
+		query.Where = append(query.Where, "("+strings.Join(conditions, " OR ")+")")
+	}
+
+	// Time range keeps tasks whose current occurrence overlaps [from, to].
+	// That is the task's own window for tasks that don't recur
+	if from_str, exists := params["from"]; exists {
+		from, err := strconv.ParseInt(from_str, 10, 64)
+		if err != nil {
+			return query, invalidParameterResponse("from")
+		}
+		query.Where = append(query.Where, fmt.Sprintf("occurrence_stop > %s", query.arg(time.Unix(from, 0))))
+	}
+	if to_str, exists := params["to"]; exists {
+		to, err := strconv.ParseInt(to_str, 10, 64)
+		if err != nil {
+			return query, invalidParameterResponse("to")
+		}
+		query.Where = append(query.Where, fmt.Sprintf("occurrence_start < %s", query.arg(time.Unix(to, 0))))
+	}
+
+	if min_likes_str, exists := params["min_likes"]; exists {
+		min_likes, err := strconv.Atoi(min_likes_str)
+		if err != nil {
+			return query, invalidParameterResponse("min_likes")
+		}
+		query.Where = append(query.Where, fmt.Sprintf("likes >= %s", query.arg(min_likes)))
+	}
+
+	if has_images_str, exists := params["has_images"]; exists {
+		has_images, err := strconv.ParseBool(has_images_str)
+		if err != nil {
+			return query, invalidParameterResponse("has_images")
+		}
+		exists_clause := "EXISTS (SELECT 1 FROM img WHERE img.task_id = task.id AND NOT img.hidden)"
+		if !has_images {
+			exists_clause = "NOT " + exists_clause
+		}
+		query.Where = append(query.Where, exists_clause)
+	}
+
+	if creator, exists := params["creator"]; exists {
+		query.Where = append(query.Where, fmt.Sprintf("creator = %s", query.arg(creator)))
+	}
+
+	sort_name := params["sort"]
+	if sort_name == "" {
+		sort_name = "start"
+		if point != "" {
+			sort_name = "distance"
+		}
+	}
+
+	if sort_name == "distance" {
+		if point == "" {
+			return query, invalidParameterResponse("sort (distance requires lat, lng or a bounding box)")
+		}
+		query.Sort = taskSort{Expr: query.Distance, Type: "double precision"}
+	} else {
+		sort, exists := taskSortKeys[sort_name]
+		if !exists {
+			return query, invalidParameterResponse("sort (must be distance, likes, num_submissions, uploaded, start or stop)")
+		}
+		query.Sort = sort
+	}
+
+	switch params["order"] {
+	case "":
+	case "asc":
+		query.Sort.Desc = false
+	case "desc":
+		query.Sort.Desc = true
+	default:
+		return query, invalidParameterResponse("order (must be asc or desc)")
+	}
+
+	// Cursors are tied to both the sort key and its direction, and distances
+	// to the point they were measured from
+	if sort_name == "distance" {
+		sort_name += "@" + point_key
+	}
+	query.Sort.Name = sort_name + ":asc"
+	if query.Sort.Desc {
+		query.Sort.Name = sort_name + ":desc"
+	}
+
+	return query, nil
+}
+
+// Copy of the request with some parameters pinned
+func withParameters(request events.APIGatewayProxyRequest, fixed map[string]string) events.APIGatewayProxyRequest {
+	params := map[string]string{}
+	for key, value := range request.QueryStringParameters {
+		params[key] = value
+	}
+	for key, value := range fixed {
+		params[key] = value
+	}
+	request.QueryStringParameters = params
+
+	return request
+}
+
+// Run a listing with some parameters pinned, as used by the fixed request
+// types. Other filters from the request still apply on top
+func listTasks(request events.APIGatewayProxyRequest, fixed map[string]string) events.APIGatewayProxyResponse {
+	request = withParameters(request, fixed)
+
+	query, res := buildTaskQuery(request)
+	if res != nil {
+		return *res
+	}
+
+	return queryTaskPage(request, query)
+}
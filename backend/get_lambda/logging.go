@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Attributes never written to the log, whatever logs them. Matched
+// case-insensitively against the attribute key
+var redactedLogKeys = map[string]bool{
+	"body":                  true,
+	"authorization":         true,
+	"x-admin-token":         true,
+	"admin_token":           true,
+	"password":              true,
+	"token":                 true,
+	"secret":                true,
+	"database_url":          true,
+	"google_maps_key":       true,
+	"calendar_feed_secret":  true,
+	"aws_secret_access_key": true,
+}
+
+// Error responses are logged up to this many bytes
+const maxLoggedErrorLength = 500
+
+// Secret values replaced in every logged string, longest first. Shorter
+// values would garble ordinary words
+var loggedSecrets []string
+
+const minLoggedSecretLength = 4
+
+func initLoggedSecrets() {
+	loggedSecrets = nil
+	for _, secret := range config.secrets() {
+		if len(secret) < minLoggedSecretLength {
+			continue
+		}
+		loggedSecrets = append(loggedSecrets, secret)
+		// URLs carry secrets escaped
+		if escaped := url.QueryEscape(secret); escaped != secret {
+			loggedSecrets = append(loggedSecrets, escaped)
+		}
+	}
+	sort.Slice(loggedSecrets, func(i, j int) bool {
+		return len(loggedSecrets[i]) > len(loggedSecrets[j])
+	})
+}
+
+func scrubSecrets(text string) string {
+	for _, secret := range loggedSecrets {
+		text = strings.ReplaceAll(text, secret, "[REDACTED]")
+	}
+	return text
+}
+
+func redactLogAttr(groups []string, attr slog.Attr) slog.Attr {
+	if redactedLogKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, "[REDACTED]")
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, scrubSecrets(attr.Value.String()))
+	case slog.KindAny:
+		// Errors are written as their message, which can quote a secret
+		if err, ok := attr.Value.Any().(error); ok {
+			return slog.String(attr.Key, scrubSecrets(err.Error()))
+		}
+	}
+	return attr
+}
+
+// JSON lines on stdout, which Lambda sends to CloudWatch
+func initLogger() {
+	initLoggedSecrets()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level:       config.LogLevel,
+		ReplaceAttr: redactLogAttr,
+	})))
+}
+
+// Log one line per request with its id, type, caller, status and latency.
+// Bodies are never logged, only the message of server errors
+func loggingMiddleware(next func(events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) func(events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		start := time.Now()
+		response, err := next(request)
+
+		attrs := []slog.Attr{
+			slog.String("request_id", request.RequestContext.RequestID),
+			slog.String("request_type", request.QueryStringParameters["request_type"]),
+			slog.String("method", request.HTTPMethod),
+			slog.String("path", request.Path),
+			slog.String("user", getRequestUser(request)),
+			slog.String("source_ip", request.RequestContext.Identity.SourceIP),
+			slog.Int("status", response.StatusCode),
+			slog.Int64("latency_ms", time.Since(start).Milliseconds()),
+		}
+
+		level := slog.LevelInfo
+		if err != nil || response.StatusCode >= 500 {
+			// Server error bodies can quote anything. Secrets are scrubbed
+			// before truncating, a cut could leave part of one that
+			// redactLogAttr no longer recognizes
+			level = slog.LevelError
+			message := response.Body
+			if err != nil {
+				message = err.Error()
+			}
+			message = scrubSecrets(message)
+			if len(message) > maxLoggedErrorLength {
+				message = message[:maxLoggedErrorLength]
+			}
+			attrs = append(attrs, slog.String("error", message))
+		}
+		slog.LogAttrs(context.Background(), level, "request", attrs...)
+
+		return response, err
+	}
+}
@@ -3,20 +3,21 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"slices"
 	"strconv"
+	"strings"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/joho/godotenv"
 	"googlemaps.github.io/maps"
 )
 
@@ -37,42 +38,70 @@ type TaskRet struct {
 	Stop            int64   `json:"stop"`
 	InitialImgId    int     `json:"initial_img_id"`
 	Likes           int     `json:"likes"`
+	NumComments     int     `json:"num_comments"`
+	Status          string  `json:"status"`
+	// Submission with the most reactions, if any has one
+	TopImgId *int `json:"top_img_id"`
+	// Recurring tasks only, as an iCalendar RRULE and seconds per occurrence
+	RRule       string          `json:"rrule,omitempty"`
+	Duration    int64           `json:"duration,omitempty"`
+	Occurrences []OccurrenceRet `json:"occurrences,omitempty"`
+	// IANA zone of the task location, with start and stop as local ISO-8601
+	TimeZone   string `json:"time_zone"`
+	StartLocal string `json:"start_local"`
+	StopLocal  string `json:"stop_local"`
+	// Meters from the queried point, only set by location queries
+	Distance *float64 `json:"distance,omitempty"`
 }
 
 type ImgRet struct {
-	Id       int    `json:"id"`
-	TaskID   int    `json:"task_id"`
-	Uploaded int64  `json:"uploaded"`
-	Caption  string `json:"caption"`
-	URL      string `json:"url"`
+	Id          int    `json:"id"`
+	TaskID      int    `json:"task_id"`
+	Uploaded    int64  `json:"uploaded"`
+	Caption     string `json:"caption"`
+	URL         string `json:"url"`
+	NumComments int    `json:"num_comments"`
+	// Reaction counts by type and the reactions of the caller
+	Reactions   map[string]int `json:"reactions"`
+	MyReactions []string       `json:"my_reactions"`
+	// Start of the occurrence this was submitted for, recurring tasks only
+	OccurrenceStart *int64 `json:"occurrence_start,omitempty"`
 }
 
 func init() {
-	// Load environment variables
-	err := godotenv.Load()
+	var err error
+	config, err = loadConfig()
 	if err != nil {
-		fmt.Println("Error loading .env file, proceeding without it...")
+		panic(err)
 	}
+	initLogger()
 
 	// Initialize Google Maps client
-	mapsClient, err = maps.NewClient(maps.WithAPIKey(os.Getenv("GOOGLE_MAPS_KEY")))
+	mapsClient, err = maps.NewClient(maps.WithAPIKey(config.GoogleMapsKey))
 	if err != nil {
 		panic(fmt.Sprintf("Failed to create Google Maps client: %v", err))
 	}
 
-	s3Client = s3.New(session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(os.Getenv("S3_REGION")),
-	})))
+	aws_config := &aws.Config{
+		Region: aws.String(config.S3Region),
+	}
+	if config.AWSAccessKeyId != "" {
+		aws_config.Credentials = credentials.NewStaticCredentials(config.AWSAccessKeyId, config.AWSSecretAccessKey, "")
+	}
+	s3Client = s3.New(session.Must(session.NewSession(aws_config)))
+
+	initRateLimiter()
 
-	pgx_config, err := pgxpool.ParseConfig(os.Getenv("DATABASE_URL"))
+	pgx_config, err := pgxpool.ParseConfig(config.DatabaseURL)
 	if err != nil {
-		panic(fmt.Sprintf("Invalid databse URL: %v", os.Getenv("DATABASE_URL")))
+		panic(fmt.Sprintf("Invalid database URL: %v", err))
 	}
-	pgx_config.MaxConns = 32
-	pgx_config.ConnConfig.ConnectTimeout = 10 * time.Second
+	pgx_config.MaxConns = int32(config.DBMaxConns)
+	pgx_config.ConnConfig.ConnectTimeout = config.DBConnectTimeout
+	pgx_config.ConnConfig.Tracer = dbMetricsTracer{}
 	dbConn, err = pgxpool.NewWithConfig(context.Background(), pgx_config)
 	if err != nil {
-		panic(fmt.Sprintf("Could not connect to database: %v", os.Getenv("DATABASE_URL")))
+		panic(fmt.Sprintf("Could not connect to database: %v", err))
 	}
 }
 
@@ -91,7 +120,7 @@ func getLatLngParameters(request events.APIGatewayProxyRequest) (float64, float6
 
 	lat, lat_err := strconv.ParseFloat(lat_str, 64)
 	lng, lng_err := strconv.ParseFloat(lng_str, 64)
-	if lat_err != nil || lng_err != nil {
+	if lat_err != nil || lng_err != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
 		return 0, 0, &events.APIGatewayProxyResponse{
 			StatusCode: 400,
 			Body:       "Invalid required parameters: lat, lng",
@@ -104,45 +133,113 @@ func getLatLngParameters(request events.APIGatewayProxyRequest) (float64, float6
 	return lat, lng, nil
 }
 
-func findClosestWaypoint(lat, lng float64) (string, string, error) {
-	// Execute the Nearby Search request
-	resp, err := mapsClient.NearbySearch(context.Background(), &maps.NearbySearchRequest{
-		Location: &maps.LatLng{
-			Lat: lat,
-			Lng: lng,
-		},
-		Radius: 5000, // Search within 5km radius
-	})
-	if err != nil {
-		return "", "", fmt.Errorf("failed to perform nearby search: %w", err)
+func getBBoxParameters(request events.APIGatewayProxyRequest) (float64, float64, float64, float64, *events.APIGatewayProxyResponse) {
+	names := []string{"min_lat", "min_lng", "max_lat", "max_lng"}
+	values := [4]float64{}
+	for i, name := range names {
+		value_str, exists := request.QueryStringParameters[name]
+		if !exists {
+			return 0, 0, 0, 0, &events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       "Missing required parameters: min_lat, min_lng, max_lat, max_lng",
+				Headers: map[string]string{
+					"Content-Type": "text/plain",
+				},
+			}
+		}
+
+		value, err := strconv.ParseFloat(value_str, 64)
+		limit := 90.0
+		if strings.HasSuffix(name, "_lng") {
+			limit = 180
+		}
+		if err != nil || value < -limit || value > limit {
+			return 0, 0, 0, 0, &events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       "Invalid required parameters: min_lat, min_lng, max_lat, max_lng",
+				Headers: map[string]string{
+					"Content-Type": "text/plain",
+				},
+			}
+		}
+		values[i] = value
 	}
 
-	// Check if there are any results
-	if len(resp.Results) == 0 {
-		return "", "", fmt.Errorf("no waypoints found near the specified location")
+	// min_lng may exceed max_lng, for viewports crossing the antimeridian
+	min_lat, min_lng, max_lat, max_lng := values[0], values[1], values[2], values[3]
+	if min_lat > max_lat {
+		return 0, 0, 0, 0, &events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid bounding box: min_lat must not exceed max_lat",
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
 	}
 
-	// Iterate through results and find the first one not a locality
-	var closest maps.PlacesSearchResult
-	for _, result := range resp.Results {
-		has_locality := slices.ContainsFunc(result.Types, func(t string) bool {
-			return t == "locality"
-		})
+	return min_lat, min_lng, max_lat, max_lng, nil
+}
+
+// Signed download link for an uploaded image
+func presignImageURL(id int) (string, error) {
+	presigned_req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(config.ImageBucket),
+		Key:    aws.String(fmt.Sprintf("%d", id)),
+	})
+	return presigned_req.Presign(config.ImageURLTTL)
+}
+
+// Identify the caller the same way post_lambda does
+func getRequestUser(request events.APIGatewayProxyRequest) string {
+	if principal, ok := request.RequestContext.Authorizer["principalId"].(string); ok && principal != "" {
+		return principal
+	}
 
-		if !has_locality {
-			closest = result
-			break
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, "X-Device-Id") && value != "" {
+			return "device:" + value
 		}
 	}
 
-	return closest.Name, closest.Vicinity, nil
+	return ""
+}
+
+// Active tasks count as ending soon once less than this much time is left
+const endingSoonWindow = time.Hour
+
+// Status of a task at the given time: upcoming, active, ending_soon or completed
+func taskStatus(start time.Time, stop time.Time, now time.Time) string {
+	switch {
+	case now.Before(start):
+		return "upcoming"
+	case !now.Before(stop):
+		return "completed"
+	case stop.Sub(now) <= endingSoonWindow:
+		return "ending_soon"
+	default:
+		return "active"
+	}
+}
+
+// Load a task's time zone, falling back to UTC for unknown names
+func taskLocation(time_zone string) *time.Location {
+	location, err := time.LoadLocation(time_zone)
+	if err != nil {
+		return time.UTC
+	}
+
+	return location
+}
+
+func formatLocalTime(unix int64, location *time.Location) string {
+	return time.Unix(unix, 0).In(location).Format(time.RFC3339)
 }
 
 type RowScanner interface {
 	Scan(dest ...interface{}) error
 }
 
-func parseTask(row RowScanner) (TaskRet, *events.APIGatewayProxyResponse) {
+func parseTask(row RowScanner, extra ...interface{}) (TaskRet, *events.APIGatewayProxyResponse) {
 	var id int
 	var title string
 	var location_name string
@@ -155,7 +252,23 @@ func parseTask(row RowScanner) (TaskRet, *events.APIGatewayProxyResponse) {
 	var stop time.Time
 	var initial_img_id int
 	var likes int
-	err := row.Scan(&id, &title, &location_name, &location_address, &description, &lat, &lng, &uploaded, &start, &stop, &initial_img_id, &likes)
+	var rrule string
+	var duration int64
+	var time_zone string
+	var num_comments int
+	var top_img_id *int
+	dest := []interface{}{&id, &title, &location_name, &location_address, &description, &lat, &lng, &uploaded, &start, &stop, &initial_img_id, &likes, &rrule, &duration, &time_zone, &num_comments, &top_img_id}
+	err := row.Scan(append(dest, extra...)...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Also when a moderator hid the task
+		return TaskRet{}, &events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       "Task not found",
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
 	if err != nil {
 		return TaskRet{}, &events.APIGatewayProxyResponse{
 			StatusCode: 500,
@@ -179,35 +292,49 @@ func parseTask(row RowScanner) (TaskRet, *events.APIGatewayProxyResponse) {
 		Stop:            stop.Unix(),
 		InitialImgId:    initial_img_id,
 		Likes:           likes,
+		NumComments:     num_comments,
+		TopImgId:        top_img_id,
+		Status:          taskStatus(start, stop, time.Now()),
+		RRule:           rrule,
+		Duration:        duration,
+		TimeZone:        time_zone,
+		StartLocal:      formatLocalTime(start.Unix(), taskLocation(time_zone)),
+		StopLocal:       formatLocalTime(stop.Unix(), taskLocation(time_zone)),
 	}, nil
 }
 
-func buildTaskJSON(rows pgx.Rows) (string, *events.APIGatewayProxyResponse) {
-	tasks := []TaskRet{}
-	for rows.Next() {
-		task, res := parseTask(rows)
-		if res != nil {
-			return "", res
-		}
-
-		tasks = append(tasks, task)
-	}
-
-	tasks_json, err := json.Marshal(tasks)
-	if err != nil {
-		return "", &events.APIGatewayProxyResponse{
-			StatusCode: 500,
-			Body:       fmt.Sprintf("JSON marshalling error: %v", err),
-			Headers: map[string]string{
-				"Content-Type": "text/plain",
-			},
-		}
-	}
-
-	return string(tasks_json), nil
+// Request types the handler serves, the only ones given their own metrics.
+// Keep in step with its switch
+var knownRequestTypes = map[string]bool{
+	"get_google_maps_key":         true,
+	"places_autocomplete":         true,
+	"place_details":               true,
+	"list_tasks":                  true,
+	"get_nearby_recent_tasks":     true,
+	"get_tasks_within_radius":     true,
+	"get_tasks_in_bbox":           true,
+	"get_task_clusters":           true,
+	"get_calendar":                true,
+	"get_calendar_token":          true,
+	"get_comments":                true,
+	"get_task":                    true,
+	"get_recent_tasks":            true,
+	"get_upcoming_tasks":          true,
+	"get_completed_tasks":         true,
+	"get_popular_tasks":           true,
+	"get_active_tasks":            true,
+	"get_recently_uploaded_tasks": true,
+	"get_images":                  true,
+	"location_to_place_name":      true,
+	"location_to_place":           true,
 }
 
 func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Map tiles are addressed by path so map libraries can template the URL
+	if tile_path, is_tile := strings.CutPrefix(request.Path, "/tiles/"); is_tile {
+		return getTaskTile(tile_path), nil
+	}
+
 	request_type, exists := request.QueryStringParameters["request_type"]
 	if !exists {
 		return events.APIGatewayProxyResponse{
@@ -221,49 +348,51 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 
 	switch request_type {
 	case "get_google_maps_key":
-		return events.APIGatewayProxyResponse{
-			StatusCode: 200,
-			Body:       os.Getenv("GOOGLE_MAPS_KEY"),
-			Headers: map[string]string{
-				"Content-Type": "text/plain",
-			},
-		}, nil
+		return getBrowserMapsKey(), nil
+	case "places_autocomplete":
+		return autocompletePlaces(request), nil
+	case "place_details":
+		return getPlaceDetails(request), nil
+	case "list_tasks":
+		return listTasks(request, nil), nil
 	case "get_nearby_recent_tasks":
-		lat, lng, res := getLatLngParameters(request)
-		if res != nil {
+		if res := requireParameters(request, "lat", "lng"); res != nil {
 			return *res, nil
 		}
 
-		rows, err := dbConn.Query(context.Background(), `
-			SELECT id, title, location_name, location_address,
-				description, lat, lng, uploaded,
-				start, stop, initial_img_id, likes
-				FROM task WHERE stop > now()
-				ORDER BY (point($1, $2) <@> (point(lat, lng)::point)) ASC
-		`, lat, lng)
-		if err != nil {
-			return events.APIGatewayProxyResponse{
-				StatusCode: 500,
-				Body:       fmt.Sprintf("Database error: %v", err),
-				Headers: map[string]string{
-					"Content-Type": "text/plain",
-				},
-			}, nil
+		return listTasks(request, map[string]string{
+			"status": "active,upcoming",
+			"sort":   "distance",
+			"order":  "asc",
+		}), nil
+	case "get_tasks_within_radius":
+		if res := requireParameters(request, "lat", "lng", "radius_km"); res != nil {
+			return *res, nil
 		}
-		defer rows.Close()
 
-		tasks_json, res := buildTaskJSON(rows)
-		if res != nil {
+		return listTasks(request, map[string]string{
+			"status": "active,upcoming",
+			"sort":   "distance",
+			"order":  "asc",
+		}), nil
+	case "get_tasks_in_bbox":
+		if res := requireParameters(request, "min_lat", "min_lng", "max_lat", "max_lng"); res != nil {
 			return *res, nil
 		}
 
-		return events.APIGatewayProxyResponse{
-			StatusCode: 200,
-			Body:       tasks_json,
-			Headers: map[string]string{
-				"Content-Type": "application/json",
-			},
-		}, nil
+		return listTasks(request, map[string]string{
+			"status": "active,upcoming",
+			"sort":   "distance",
+			"order":  "asc",
+		}), nil
+	case "get_task_clusters":
+		return getTaskClusters(request), nil
+	case "get_calendar":
+		return getCalendar(request), nil
+	case "get_calendar_token":
+		return getCalendarToken(request), nil
+	case "get_comments":
+		return getComments(request), nil
 	case "get_task":
 		id, id_exists := request.QueryStringParameters["id"]
 		if !id_exists {
@@ -279,14 +408,17 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 		row := dbConn.QueryRow(context.Background(), `
 			SELECT id, title, location_name, location_address,
 				description, lat, lng, uploaded,
-				start, stop, initial_img_id, likes
-				FROM task WHERE id = $1
+				start, stop, initial_img_id, likes,
+				rrule, duration, time_zone, num_comments, top_img_id
+				FROM task WHERE id = $1 AND NOT hidden
 		`, id)
 
 		task, res := parseTask(row)
 		if res != nil {
 			return *res, nil
 		}
+		occurrences_from, occurrences_to := getOccurrenceRange(request)
+		expandOccurrences(&task, occurrences_from, occurrences_to)
 
 		task_json, err := json.Marshal(task)
 		if err != nil {
@@ -307,155 +439,41 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 			},
 		}, nil
 	case "get_recent_tasks":
-		rows, err := dbConn.Query(context.Background(), `
-			SELECT id, title, location_name, location_address,
-				description, lat, lng, uploaded,
-				start, stop, initial_img_id, likes
-				FROM task WHERE start < $1 AND stop > $1 ORDER BY start ASC
-		`, time.Now())
-		if err != nil {
-			return events.APIGatewayProxyResponse{
-				StatusCode: 500,
-				Body:       fmt.Sprintf("Database error: %v", err),
-				Headers: map[string]string{
-					"Content-Type": "text/plain",
-				},
-			}, nil
-		}
-		defer rows.Close()
-
-		tasks_json, res := buildTaskJSON(rows)
-		if res != nil {
-			return *res, nil
-		}
-
-		return events.APIGatewayProxyResponse{
-			StatusCode: 200,
-			Body:       tasks_json,
-			Headers: map[string]string{
-				"Content-Type": "application/json",
-			},
-		}, nil
+		return listTasks(request, map[string]string{
+			"status": "active",
+			"sort":   "start",
+			"order":  "asc",
+		}), nil
+	case "get_upcoming_tasks":
+		return listTasks(request, map[string]string{
+			"status": "upcoming",
+			"sort":   "start",
+			"order":  "asc",
+		}), nil
 	case "get_completed_tasks":
-		rows, err := dbConn.Query(context.Background(), `
-			SELECT id, title, location_name, location_address,
-				description, lat, lng, uploaded,
-				start, stop, initial_img_id, likes
-				FROM task WHERE stop < $1 ORDER BY stop DESC
-		`, time.Now())
-		if err != nil {
-			return events.APIGatewayProxyResponse{
-				StatusCode: 500,
-				Body:       fmt.Sprintf("Database error: %v", err),
-				Headers: map[string]string{
-					"Content-Type": "text/plain",
-				},
-			}, nil
-		}
-		defer rows.Close()
-
-		tasks_json, res := buildTaskJSON(rows)
-		if res != nil {
-			return *res, nil
-		}
-
-		return events.APIGatewayProxyResponse{
-			StatusCode: 200,
-			Body:       tasks_json,
-			Headers: map[string]string{
-				"Content-Type": "application/json",
-			},
-		}, nil
+		return listTasks(request, map[string]string{
+			"status": "completed",
+			"sort":   "stop",
+			"order":  "desc",
+		}), nil
 	case "get_popular_tasks":
-		rows, err := dbConn.Query(context.Background(), `
-			SELECT id, title, location_name, location_address,
-				description, lat, lng, uploaded,
-				start, stop, initial_img_id, likes
-				FROM task WHERE start < $1 AND stop > $1 ORDER BY likes DESC
-		`, time.Now())
-		if err != nil {
-			return events.APIGatewayProxyResponse{
-				StatusCode: 500,
-				Body:       fmt.Sprintf("Database error: %v", err),
-				Headers: map[string]string{
-					"Content-Type": "text/plain",
-				},
-			}, nil
-		}
-		defer rows.Close()
-
-		tasks_json, res := buildTaskJSON(rows)
-		if res != nil {
-			return *res, nil
-		}
-
-		return events.APIGatewayProxyResponse{
-			StatusCode: 200,
-			Body:       tasks_json,
-			Headers: map[string]string{
-				"Content-Type": "application/json",
-			},
-		}, nil
+		return listTasks(request, map[string]string{
+			"status": "active",
+			"sort":   "likes",
+			"order":  "desc",
+		}), nil
 	case "get_active_tasks":
-		rows, err := dbConn.Query(context.Background(), `
-			SELECT id, title, location_name, location_address,
-				description, lat, lng, uploaded,
-				start, stop, initial_img_id, likes
-				FROM task WHERE start < $1 AND stop > $1 ORDER BY num_submissions DESC
-		`, time.Now())
-		if err != nil {
-			return events.APIGatewayProxyResponse{
-				StatusCode: 500,
-				Body:       fmt.Sprintf("Database error: %v", err),
-				Headers: map[string]string{
-					"Content-Type": "text/plain",
-				},
-			}, nil
-		}
-		defer rows.Close()
-
-		tasks_json, res := buildTaskJSON(rows)
-		if res != nil {
-			return *res, nil
-		}
-
-		return events.APIGatewayProxyResponse{
-			StatusCode: 200,
-			Body:       tasks_json,
-			Headers: map[string]string{
-				"Content-Type": "application/json",
-			},
-		}, nil
+		return listTasks(request, map[string]string{
+			"status": "active",
+			"sort":   "num_submissions",
+			"order":  "desc",
+		}), nil
 	case "get_recently_uploaded_tasks":
-		rows, err := dbConn.Query(context.Background(), `
-			SELECT id, title, location_name, location_address,
-				description, lat, lng, uploaded,
-				start, stop, initial_img_id, likes
-				FROM task WHERE start < $1 AND stop > $1 ORDER BY uploaded ASC
-		`, time.Now())
-		if err != nil {
-			return events.APIGatewayProxyResponse{
-				StatusCode: 500,
-				Body:       fmt.Sprintf("Database error: %v", err),
-				Headers: map[string]string{
-					"Content-Type": "text/plain",
-				},
-			}, nil
-		}
-		defer rows.Close()
-
-		tasks_json, res := buildTaskJSON(rows)
-		if res != nil {
-			return *res, nil
-		}
-
-		return events.APIGatewayProxyResponse{
-			StatusCode: 200,
-			Body:       tasks_json,
-			Headers: map[string]string{
-				"Content-Type": "application/json",
-			},
-		}, nil
+		return listTasks(request, map[string]string{
+			"status": "active",
+			"sort":   "uploaded",
+			"order":  "asc",
+		}), nil
 	case "get_images":
 		task_id_str, task_id_exists := request.QueryStringParameters["task_id"]
 		if !task_id_exists {
@@ -479,10 +497,47 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 			}, nil
 		}
 
-		rows, err := dbConn.Query(context.Background(), `
-			SELECT id, uploaded, caption
-				FROM img WHERE task_id = $1
-		`, task_id)
+		// Submissions of a recurring task can be narrowed to one occurrence
+		var occurrence_start *time.Time
+		if occurrence_str, exists := request.QueryStringParameters["occurrence_start"]; exists {
+			occurrence_unix, err := strconv.ParseInt(occurrence_str, 10, 64)
+			if err != nil {
+				return events.APIGatewayProxyResponse{
+					StatusCode: 400,
+					Body:       "Invalid parameters: occurrence_start",
+					Headers: map[string]string{
+						"Content-Type": "text/plain",
+					},
+				}, nil
+			}
+			occurrence_time := time.Unix(occurrence_unix, 0)
+			occurrence_start = &occurrence_time
+		}
+
+		// Most reacted first on request, for showing the best submissions
+		order_by := "uploaded, id"
+		switch request.QueryStringParameters["sort"] {
+		case "", "uploaded":
+		case "reactions":
+			order_by = "num_reactions DESC, uploaded, id"
+		default:
+			return *invalidParameterResponse("sort (must be uploaded or reactions)"), nil
+		}
+
+		rows, err := dbConn.Query(context.Background(), fmt.Sprintf(`
+			SELECT id, uploaded, caption, occurrence_start,
+				(SELECT count(*) FROM comment WHERE comment.img_id = img.id AND NOT deleted AND NOT hidden),
+				(SELECT json_object_agg(reaction, count) FROM (
+					SELECT reaction, count(*) FROM img_reaction
+						WHERE img_reaction.img_id = img.id GROUP BY reaction
+				) counts),
+				ARRAY(SELECT reaction FROM img_reaction
+					WHERE img_reaction.img_id = img.id AND user_id = $3 ORDER BY reaction)
+				FROM img WHERE task_id = $1 AND NOT hidden
+				AND NOT EXISTS (SELECT 1 FROM task WHERE task.id = $1 AND task.hidden)
+				AND ($2::timestamptz IS NULL OR occurrence_start = $2)
+				ORDER BY %s
+		`, order_by), task_id, occurrence_start, getRequestUser(request))
 		if err != nil {
 			return events.APIGatewayProxyResponse{
 				StatusCode: 500,
@@ -499,7 +554,11 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 			var id int
 			var uploaded time.Time
 			var caption string
-			err := rows.Scan(&id, &uploaded, &caption)
+			var img_occurrence_start *time.Time
+			var num_comments int
+			var reactions map[string]int
+			var my_reactions []string
+			err := rows.Scan(&id, &uploaded, &caption, &img_occurrence_start, &num_comments, &reactions, &my_reactions)
 			if err != nil {
 				return events.APIGatewayProxyResponse{
 					StatusCode: 500,
@@ -510,22 +569,42 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 				}, nil
 			}
 
-			presigned_req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
-				Bucket: aws.String("spontaniapp-imgs"),
-				Key:    aws.String(fmt.Sprintf("%d", id)),
-			})
-			presigned_url, err := presigned_req.Presign(7 * 24 * time.Hour)
+			presigned_url, err := presignImageURL(id)
 			if err != nil {
 				panic(fmt.Errorf("error in raw video presigned URL: %v", err))
 			}
 
-			imgs = append(imgs, ImgRet{
-				Id:       id,
-				TaskID:   task_id,
-				Uploaded: uploaded.Unix(),
-				Caption:  caption,
-				URL:      presigned_url,
-			})
+			img := ImgRet{
+				Id:          id,
+				TaskID:      task_id,
+				Uploaded:    uploaded.Unix(),
+				Caption:     caption,
+				URL:         presigned_url,
+				NumComments: num_comments,
+				Reactions:   reactions,
+				MyReactions: my_reactions,
+			}
+			if img.Reactions == nil {
+				img.Reactions = map[string]int{}
+			}
+			if img.MyReactions == nil {
+				img.MyReactions = []string{}
+			}
+			if img_occurrence_start != nil {
+				occurrence_unix := img_occurrence_start.Unix()
+				img.OccurrenceStart = &occurrence_unix
+			}
+
+			imgs = append(imgs, img)
+		}
+		if err := rows.Err(); err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       fmt.Sprintf("Database error: %v", err),
+				Headers: map[string]string{
+					"Content-Type": "text/plain",
+				},
+			}, nil
 		}
 
 		imgs_json, err := json.Marshal(imgs)
@@ -552,11 +631,34 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 			return *res, nil
 		}
 
-		name, _, err := findClosestWaypoint(lat, lng)
+		place, err := findClosestPlace(lat, lng)
+		if err != nil {
+			return placesErrorResponse(err), nil
+		}
+
+		return events.APIGatewayProxyResponse{
+			StatusCode: 200,
+			Body:       place.Name,
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}, nil
+	case "location_to_place":
+		lat, lng, res := getLatLngParameters(request)
+		if res != nil {
+			return *res, nil
+		}
+
+		place, err := findClosestPlace(lat, lng)
+		if err != nil {
+			return placesErrorResponse(err), nil
+		}
+
+		place_json, err := json.Marshal(place)
 		if err != nil {
 			return events.APIGatewayProxyResponse{
 				StatusCode: 500,
-				Body:       fmt.Sprintf("Waypoint naming error: %v", err),
+				Body:       fmt.Sprintf("JSON marshalling error: %v", err),
 				Headers: map[string]string{
 					"Content-Type": "text/plain",
 				},
@@ -565,9 +667,9 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 
 		return events.APIGatewayProxyResponse{
 			StatusCode: 200,
-			Body:       name,
+			Body:       string(place_json),
 			Headers: map[string]string{
-				"Content-Type": "text/plain",
+				"Content-Type": "application/json",
 			},
 		}, nil
 	default:
@@ -581,27 +683,14 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 	}
 }
 
-func corsHandlerWrapper(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	response, err := handler(request)
-	if err != nil {
-		return events.APIGatewayProxyResponse{
-			StatusCode: 500,
-			Body:       fmt.Sprintf("Internal server error: %v", err),
-			Headers: map[string]string{
-				"Content-Type": "text/plain",
-			},
-		}, nil
+func main() {
+	wrapped_handler := metricsMiddleware(loggingMiddleware(corsMiddleware(rateLimitMiddleware(handler))))
+	if config.LocalMode {
+		if err := runLocalServer(wrapped_handler); err != nil {
+			panic(fmt.Sprintf("Local server failed: %v", err))
+		}
+		return
 	}
 
-	response.Headers = map[string]string{}
-	response.Headers["Access-Control-Allow-Origin"] = "*"
-	response.Headers["Access-Control-Allow-Headers"] = "*"
-	response.Headers["Access-Control-Allow-Methods"] = "*"
-	response.Headers["Access-Control-Allow-Credentials"] = "true"
-
-	return response, nil
-}
-
-func main() {
-	lambda.Start(corsHandlerWrapper)
+	lambda.Start(wrapped_handler)
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+	"googlemaps.github.io/maps"
+)
+
+// Autocomplete input longer than this is never a place name
+const maxAutocompleteInput = 200
+
+// Suggestions are biased to this many meters around lat, lng when given
+const autocompleteBiasRadius = 50000
+
+type PlacePredictionRet struct {
+	PlaceId       string   `json:"place_id"`
+	Description   string   `json:"description"`
+	MainText      string   `json:"main_text"`
+	SecondaryText string   `json:"secondary_text"`
+	Types         []string `json:"types"`
+	// Meters from lat, lng when given
+	Distance int `json:"distance,omitempty"`
+}
+
+type PlaceDetailsRet struct {
+	PlaceId          string   `json:"place_id"`
+	Name             string   `json:"name"`
+	FormattedAddress string   `json:"formatted_address"`
+	Types            []string `json:"types"`
+	Lat              float64  `json:"lat"`
+	Lng              float64  `json:"lng"`
+}
+
+// Only basic fields are requested, the others are billed extra
+var placeDetailsFields = []maps.PlaceDetailsFieldMask{
+	maps.PlaceDetailsFieldMaskPlaceID,
+	maps.PlaceDetailsFieldMaskName,
+	maps.PlaceDetailsFieldMaskFormattedAddress,
+	maps.PlaceDetailsFieldMaskTypes,
+	maps.PlaceDetailsFieldMaskGeometryLocation,
+}
+
+// Key for the Maps JavaScript API in the browser. It is a separate key
+// restricted by HTTP referrer, the server key in GOOGLE_MAPS_KEY is never
+// handed out
+func getBrowserMapsKey() events.APIGatewayProxyResponse {
+	if config.GoogleMapsBrowserKey == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 503,
+			Body:       "Maps are not configured",
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       config.GoogleMapsBrowserKey,
+		Headers: map[string]string{
+			"Content-Type": "text/plain",
+		},
+	}
+}
+
+// Autocomplete and details requests sharing a session token are billed as
+// one session. The token is optional and comes from the browser
+func getSessionToken(request events.APIGatewayProxyRequest) (maps.PlaceAutocompleteSessionToken, *events.APIGatewayProxyResponse) {
+	token_str, exists := request.QueryStringParameters["session_token"]
+	if !exists {
+		return maps.PlaceAutocompleteSessionToken{}, nil
+	}
+
+	token, err := uuid.Parse(token_str)
+	if err != nil {
+		return maps.PlaceAutocompleteSessionToken{}, invalidParameterResponse("session_token")
+	}
+
+	return maps.PlaceAutocompleteSessionToken(token), nil
+}
+
+// Places failures are logged, callers only learn that the lookup failed
+func placesErrorResponse(err error) events.APIGatewayProxyResponse {
+	// Errors of the maps client quote the request URL, key included
+	slog.Error("places lookup failed", "error", err)
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 502,
+		Body:       "Places lookup failed",
+		Headers: map[string]string{
+			"Content-Type": "text/plain",
+		},
+	}
+}
+
+func placesJSONResponse(ret interface{}) events.APIGatewayProxyResponse {
+	ret_json, err := json.Marshal(ret)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("JSON marshalling error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       string(ret_json),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
+
+func placesProxyDisabledResponse() events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: 404,
+		Body:       "Not found",
+		Headers: map[string]string{
+			"Content-Type": "text/plain",
+		},
+	}
+}
+
+// Place suggestions for a search box, optionally near lat, lng
+func autocompletePlaces(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if !config.Features.PlacesProxy {
+		return placesProxyDisabledResponse()
+	}
+	if res := requireParameters(request, "input"); res != nil {
+		return *res
+	}
+	input := strings.TrimSpace(request.QueryStringParameters["input"])
+	if input == "" || len(input) > maxAutocompleteInput {
+		return *invalidParameterResponse("input")
+	}
+
+	session_token, res := getSessionToken(request)
+	if res != nil {
+		return *res
+	}
+
+	autocomplete_request := &maps.PlaceAutocompleteRequest{
+		Input:        input,
+		SessionToken: session_token,
+	}
+	if _, exists := request.QueryStringParameters["lat"]; exists {
+		lat, lng, res := getLatLngParameters(request)
+		if res != nil {
+			return *res
+		}
+		autocomplete_request.Location = &maps.LatLng{Lat: lat, Lng: lng}
+		autocomplete_request.Origin = &maps.LatLng{Lat: lat, Lng: lng}
+		autocomplete_request.Radius = autocompleteBiasRadius
+	}
+
+	start := time.Now()
+	resp, err := mapsClient.PlaceAutocomplete(context.Background(), autocomplete_request)
+	observeExternalCall("geocoder", "place_autocomplete", start, err)
+	if err != nil {
+		return placesErrorResponse(err)
+	}
+
+	predictions := []PlacePredictionRet{}
+	for _, prediction := range resp.Predictions {
+		types := prediction.Types
+		if types == nil {
+			types = []string{}
+		}
+		predictions = append(predictions, PlacePredictionRet{
+			PlaceId:       prediction.PlaceID,
+			Description:   prediction.Description,
+			MainText:      prediction.StructuredFormatting.MainText,
+			SecondaryText: prediction.StructuredFormatting.SecondaryText,
+			Types:         types,
+			Distance:      prediction.DistanceMeters,
+		})
+	}
+
+	return placesJSONResponse(predictions)
+}
+
+// Name, address and position of a suggestion the user picked
+func getPlaceDetails(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if !config.Features.PlacesProxy {
+		return placesProxyDisabledResponse()
+	}
+	if res := requireParameters(request, "place_id"); res != nil {
+		return *res
+	}
+	place_id := request.QueryStringParameters["place_id"]
+	if place_id == "" || len(place_id) > 256 {
+		return *invalidParameterResponse("place_id")
+	}
+
+	session_token, res := getSessionToken(request)
+	if res != nil {
+		return *res
+	}
+
+	start := time.Now()
+	result, err := mapsClient.PlaceDetails(context.Background(), &maps.PlaceDetailsRequest{
+		PlaceID:      place_id,
+		Fields:       placeDetailsFields,
+		SessionToken: session_token,
+	})
+	observeExternalCall("geocoder", "place_details", start, err)
+	if err != nil {
+		return placesErrorResponse(err)
+	}
+
+	types := result.Types
+	if types == nil {
+		types = []string{}
+	}
+
+	return placesJSONResponse(PlaceDetailsRet{
+		PlaceId:          result.PlaceID,
+		Name:             result.Name,
+		FormattedAddress: result.FormattedAddress,
+		Types:            types,
+		Lat:              result.Geometry.Location.Lat,
+		Lng:              result.Geometry.Location.Lng,
+	})
+}
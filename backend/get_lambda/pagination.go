@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/jackc/pgx/v5"
+)
+
+const defaultPageLimit = 50
+const maxPageLimit = 200
+
+// Opaque cursor handed to clients in the X-Next-Cursor header. SortKey holds
+// the text form of the sort expression for the last row so it can be cast
+// back in SQL
+type pageCursor struct {
+	Sort    string `json:"s"`
+	SortKey string `json:"k"`
+	Id      int    `json:"id"`
+}
+
+type taskSort struct {
+	Name string
+	Expr string
+	// SQL type of Expr, used to cast cursor values back
+	Type string
+	Desc bool
+}
+
+type taskQuery struct {
+	// Conditions ANDed together, referencing Args by position
+	Where []string
+	Args  []interface{}
+	// Optional SQL expression returned as the distance of each task
+	Distance string
+	Sort     taskSort
+}
+
+// Add a query argument and return its placeholder
+func (q *taskQuery) arg(value interface{}) string {
+	q.Args = append(q.Args, value)
+	return fmt.Sprintf("$%d", len(q.Args))
+}
+
+func encodeCursor(cursor pageCursor) string {
+	cursor_json, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(cursor_json)
+}
+
+func decodeCursor(cursor_str string) (pageCursor, error) {
+	var cursor pageCursor
+	cursor_json, err := base64.RawURLEncoding.DecodeString(cursor_str)
+	if err != nil {
+		return cursor, err
+	}
+
+	err = json.Unmarshal(cursor_json, &cursor)
+	return cursor, err
+}
+
+func getPaginationParameters(request events.APIGatewayProxyRequest, sort taskSort) (int, *pageCursor, *events.APIGatewayProxyResponse) {
+	limit := defaultPageLimit
+	if limit_str, exists := request.QueryStringParameters["limit"]; exists {
+		var err error
+		limit, err = strconv.Atoi(limit_str)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return 0, nil, &events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf("Invalid parameters: limit (must be between 1 and %d)", maxPageLimit),
+				Headers: map[string]string{
+					"Content-Type": "text/plain",
+				},
+			}
+		}
+	}
+
+	cursor, res := getCursorParameter(request, sort)
+	if res != nil {
+		return 0, nil, res
+	}
+
+	return limit, cursor, nil
+}
+
+func getCursorParameter(request events.APIGatewayProxyRequest, sort taskSort) (*pageCursor, *events.APIGatewayProxyResponse) {
+	cursor_str, exists := request.QueryStringParameters["cursor"]
+	if !exists || cursor_str == "" {
+		return nil, nil
+	}
+
+	// A cursor is only valid for the ordering it was issued for
+	cursor, err := decodeCursor(cursor_str)
+	if err != nil || cursor.Sort != sort.Name {
+		return nil, &events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid parameters: cursor",
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	return &cursor, nil
+}
+
+// Run a task query starting after cursor, if any. Rows hold the task
+// columns followed by the distance and the text form of the sort key
+func queryTasks(query taskQuery, cursor *pageCursor, limit int) (pgx.Rows, error) {
+	direction, comparison := "ASC", ">"
+	if query.Sort.Desc {
+		direction, comparison = "DESC", "<"
+	}
+
+	// Moderators hide tasks from every listing
+	where := append([]string{"NOT hidden"}, query.Where...)
+	if cursor != nil {
+		where = append(where, fmt.Sprintf("(%s, id) %s (%s::text::%s, %s)",
+			query.Sort.Expr, comparison, query.arg(cursor.SortKey), query.Sort.Type, query.arg(cursor.Id)))
+	}
+
+	where_clause := ""
+	if len(where) > 0 {
+		where_clause = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	distance_select := "NULL::double precision"
+	if query.Distance != "" {
+		distance_select = query.Distance
+	}
+
+	return dbConn.Query(context.Background(), fmt.Sprintf(`
+		SELECT id, title, location_name, location_address,
+			description, lat, lng, uploaded,
+			start, stop, initial_img_id, likes,
+			rrule, duration, time_zone, num_comments, top_img_id,
+			%s, (%s)::text
+			FROM task %s
+			ORDER BY %s %s, id %s
+			LIMIT %s
+	`, distance_select, query.Sort.Expr, where_clause,
+		query.Sort.Expr, direction, direction, query.arg(limit)), query.Args...)
+}
+
+func queryTaskPage(request events.APIGatewayProxyRequest, query taskQuery) events.APIGatewayProxyResponse {
+	format, res := getExportFormat(request)
+	if res != nil {
+		return *res
+	}
+	if format != "" {
+		return exportTasks(request, query, format)
+	}
+
+	limit, cursor, res := getPaginationParameters(request, query.Sort)
+	if res != nil {
+		return *res
+	}
+
+	// Fetch one extra row to know whether another page exists
+	rows, err := queryTasks(query, cursor, limit+1)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+	defer rows.Close()
+
+	occurrences_from, occurrences_to := getOccurrenceRange(request)
+	// Listings stay a plain array, the cursor for the next page comes in the
+	// X-Next-Cursor header when there is one
+	page := []TaskRet{}
+	var next_cursor string
+	var last_sort_key string
+	for rows.Next() {
+		var distance *float64
+		var sort_key string
+		task, res := parseTask(rows, &distance, &sort_key)
+		if res != nil {
+			return *res
+		}
+		task.Distance = distance
+		expandOccurrences(&task, occurrences_from, occurrences_to)
+
+		if len(page) == limit {
+			next_cursor = encodeCursor(pageCursor{
+				Sort:    query.Sort.Name,
+				SortKey: last_sort_key,
+				Id:      page[limit-1].Id,
+			})
+			break
+		}
+
+		page = append(page, task)
+		last_sort_key = sort_key
+	}
+	if err := rows.Err(); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	page_json, err := json.Marshal(page)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("JSON marshalling error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	headers := map[string]string{
+		"Content-Type": "application/json",
+	}
+	if next_cursor != "" {
+		headers["X-Next-Cursor"] = next_cursor
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       string(page_json),
+		Headers:    headers,
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"time"
+
+	"googlemaps.github.io/maps"
+)
+
+// Radius searched around the pin
+const placeSearchRadius = 5000
+
+type Place struct {
+	Name             string   `json:"name"`
+	FormattedAddress string   `json:"formatted_address"`
+	Types            []string `json:"types"`
+	PlaceId          string   `json:"place_id"`
+	// Meters from the pin
+	Distance float64 `json:"distance"`
+	City     string  `json:"city"`
+	Country  string  `json:"country"`
+}
+
+// How much each place type makes a good name for a task location. Places
+// people go to rank above shops and offices, whole areas and roads below
+var placeTypeScores = map[string]float64{
+	"tourist_attraction": 6,
+	"park":               6,
+	"natural_feature":    5,
+	"amusement_park":     5,
+	"zoo":                5,
+	"aquarium":           5,
+	"museum":             5,
+	"stadium":            4,
+	"campground":         4,
+	"art_gallery":        4,
+	"church":             3,
+	"place_of_worship":   3,
+	"library":            3,
+	"university":         3,
+	"city_hall":          3,
+	"transit_station":    2,
+	"point_of_interest":  1,
+	"store":              -2,
+	"restaurant":         -1,
+	"food":               -1,
+	"lodging":            -2,
+	"finance":            -3,
+	"health":             -2,
+	"car_repair":         -3,
+	"real_estate_agency": -3,
+	"route":              -4,
+	"neighborhood":       -4,
+	"sublocality":        -6,
+	"locality":           -8,
+	"political":          -8,
+}
+
+// Score lost per kilometer from the pin
+const placeDistancePenalty = 3
+
+// Great circle distance in meters
+func haversineDistance(lat1, lng1, lat2, lng2 float64) float64 {
+	const earth_radius = 6371000
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	delta_phi := (lat2 - lat1) * math.Pi / 180
+	delta_lambda := (lng2 - lng1) * math.Pi / 180
+
+	a := math.Sin(delta_phi/2)*math.Sin(delta_phi/2) +
+		math.Cos(phi1)*math.Cos(phi2)*math.Sin(delta_lambda/2)*math.Sin(delta_lambda/2)
+	return earth_radius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Prefer landmarks, parks and points of interest close to the pin, with well
+// known places getting a small boost from their number of ratings
+func scorePlace(result maps.PlacesSearchResult, distance float64) float64 {
+	score := 0.0
+	best_type := math.Inf(-1)
+	for _, place_type := range result.Types {
+		if type_score, exists := placeTypeScores[place_type]; exists && type_score > best_type {
+			best_type = type_score
+		}
+	}
+	if !math.IsInf(best_type, -1) {
+		score += best_type
+	}
+
+	if result.BusinessStatus == "CLOSED_PERMANENTLY" {
+		score -= 10
+	}
+
+	score += math.Log10(float64(result.UserRatingsTotal) + 1)
+	score -= placeDistancePenalty * distance / 1000
+
+	return score
+}
+
+// City and country of the pin, straight from reverse geocoding
+func lookupCityAndCountry(lat, lng float64) (string, string, error) {
+	start := time.Now()
+	results, err := mapsClient.ReverseGeocode(context.Background(), &maps.GeocodingRequest{
+		LatLng: &maps.LatLng{Lat: lat, Lng: lng},
+	})
+	observeExternalCall("geocoder", "reverse_geocode", start, err)
+	if err != nil {
+		return "", "", err
+	}
+
+	var city, fallback_city, country string
+	for _, result := range results {
+		for _, component := range result.AddressComponents {
+			switch {
+			case city == "" && (slices.Contains(component.Types, "locality") || slices.Contains(component.Types, "postal_town")):
+				city = component.LongName
+			case fallback_city == "" && slices.Contains(component.Types, "administrative_area_level_2"):
+				fallback_city = component.LongName
+			case country == "" && slices.Contains(component.Types, "country"):
+				country = component.LongName
+			}
+		}
+	}
+	if city == "" {
+		city = fallback_city
+	}
+
+	return city, country, nil
+}
+
+// Best scoring place near the pin, straight from the Places API
+func lookupClosestPlace(lat, lng float64) (Place, error) {
+	start := time.Now()
+	resp, err := mapsClient.NearbySearch(context.Background(), &maps.NearbySearchRequest{
+		Location: &maps.LatLng{
+			Lat: lat,
+			Lng: lng,
+		},
+		Radius: placeSearchRadius,
+	})
+	observeExternalCall("geocoder", "nearby_search", start, err)
+	if err != nil {
+		return Place{}, fmt.Errorf("failed to perform nearby search: %w", err)
+	}
+
+	if len(resp.Results) == 0 {
+		return Place{}, fmt.Errorf("no waypoints found near the specified location")
+	}
+
+	var best maps.PlacesSearchResult
+	best_score := math.Inf(-1)
+	best_distance := 0.0
+	for _, result := range resp.Results {
+		distance := haversineDistance(lat, lng, result.Geometry.Location.Lat, result.Geometry.Location.Lng)
+		if score := scorePlace(result, distance); score > best_score {
+			best, best_score, best_distance = result, score, distance
+		}
+	}
+
+	place := Place{
+		Name:             best.Name,
+		FormattedAddress: best.FormattedAddress,
+		Types:            best.Types,
+		PlaceId:          best.PlaceID,
+		Distance:         math.Round(best_distance),
+	}
+	// Nearby Search only fills in the short vicinity address
+	if place.FormattedAddress == "" {
+		place.FormattedAddress = best.Vicinity
+	}
+	if place.Types == nil {
+		place.Types = []string{}
+	}
+
+	// A place without a city is still a good answer. Nearby Search results
+	// have no address components, the city comes from reverse geocoding
+	place.City, place.Country, err = findCityAndCountry(lat, lng)
+	if err != nil {
+		slog.Warn("reverse geocoding failed", "error", err)
+	}
+
+	return place, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const tileMaxZoom = 22
+
+// Tiles are cheap to rebuild but popular areas get requested constantly, so
+// let browsers and the CDN reuse them for a short while
+const tileCacheControl = "public, max-age=60, stale-while-revalidate=300"
+
+// Parse a "{z}/{x}/{y}.mvt" tile path
+func parseTilePath(path string) (int, int, int, error) {
+	parts := strings.Split(strings.TrimSuffix(strings.Trim(path, "/"), ".mvt"), "/")
+	if len(parts) != 3 {
+		return 0, 0, 0, fmt.Errorf("expected {z}/{x}/{y}.mvt")
+	}
+
+	coords := [3]int{}
+	for i, part := range parts {
+		value, err := strconv.Atoi(part)
+		if err != nil || value < 0 {
+			return 0, 0, 0, fmt.Errorf("invalid tile coordinate %q", part)
+		}
+		coords[i] = value
+	}
+
+	z, x, y := coords[0], coords[1], coords[2]
+	if z > tileMaxZoom || x >= 1<<z || y >= 1<<z {
+		return 0, 0, 0, fmt.Errorf("tile %d/%d/%d out of range", z, x, y)
+	}
+
+	return z, x, y, nil
+}
+
+// Encode the active tasks inside a web mercator tile as a Mapbox Vector Tile
+// with a single "tasks" layer
+func getTaskTile(tile_path string) events.APIGatewayProxyResponse {
+	z, x, y, err := parseTilePath(tile_path)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf("Invalid tile path: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	var tile []byte
+	err = dbConn.QueryRow(context.Background(), `
+		WITH bounds AS (
+			SELECT ST_TileEnvelope($1, $2, $3) AS geom
+		), features AS (
+			SELECT ST_AsMVTGeom(ST_Transform(location::geometry, 3857), bounds.geom) AS geom,
+				id, title, likes, extract(epoch FROM occurrence_stop)::bigint AS stop
+				FROM task, bounds
+				WHERE occurrence_start < $4 AND occurrence_stop > $4 AND NOT hidden
+				AND location && ST_Transform(bounds.geom, 4326)::geography
+		)
+		SELECT ST_AsMVT(features, 'tasks', 4096, 'geom') FROM features
+	`, z, x, y, time.Now()).Scan(&tile)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode:      200,
+		Body:            base64.StdEncoding.EncodeToString(tile),
+		IsBase64Encoded: true,
+		Headers: map[string]string{
+			"Content-Type":  "application/vnd.mapbox-vector-tile",
+			"Cache-Control": tileCacheControl,
+		},
+	}
+}
@@ -0,0 +1,36 @@
+DROP INDEX IF EXISTS img_task_id_idx;
+
+ALTER TABLE img
+	DROP CONSTRAINT IF EXISTS img_task_id_fkey,
+	ALTER COLUMN caption DROP DEFAULT,
+	ALTER COLUMN caption DROP NOT NULL,
+	ALTER COLUMN uploaded DROP DEFAULT,
+	ALTER COLUMN uploaded DROP NOT NULL,
+	DROP CONSTRAINT IF EXISTS img_pkey,
+	ADD CONSTRAINT img_id_key UNIQUE (id);
+ALTER SEQUENCE img_id OWNED BY NONE;
+
+ALTER TABLE task
+	ALTER COLUMN num_submissions DROP DEFAULT,
+	ALTER COLUMN num_submissions DROP NOT NULL,
+	ALTER COLUMN likes DROP DEFAULT,
+	ALTER COLUMN likes DROP NOT NULL,
+	ALTER COLUMN initial_img_id DROP DEFAULT,
+	ALTER COLUMN initial_img_id DROP NOT NULL,
+	ALTER COLUMN stop DROP NOT NULL,
+	ALTER COLUMN start DROP NOT NULL,
+	ALTER COLUMN uploaded DROP DEFAULT,
+	ALTER COLUMN uploaded DROP NOT NULL,
+	ALTER COLUMN lng DROP NOT NULL,
+	ALTER COLUMN lat DROP NOT NULL,
+	ALTER COLUMN description DROP DEFAULT,
+	ALTER COLUMN description DROP NOT NULL,
+	ALTER COLUMN location_address DROP DEFAULT,
+	ALTER COLUMN location_address DROP NOT NULL,
+	ALTER COLUMN location_name DROP DEFAULT,
+	ALTER COLUMN location_name DROP NOT NULL,
+	ALTER COLUMN title DROP DEFAULT,
+	ALTER COLUMN title DROP NOT NULL,
+	DROP CONSTRAINT IF EXISTS task_pkey,
+	ADD CONSTRAINT task_id_key UNIQUE (id);
+ALTER SEQUENCE task_id OWNED BY NONE;
@@ -0,0 +1,55 @@
+-- Repair existing rows so the constraints below can be applied
+UPDATE task SET title = '' WHERE title IS NULL;
+UPDATE task SET location_name = '' WHERE location_name IS NULL;
+UPDATE task SET location_address = '' WHERE location_address IS NULL;
+UPDATE task SET description = '' WHERE description IS NULL;
+UPDATE task SET lat = 0 WHERE lat IS NULL;
+UPDATE task SET lng = 0 WHERE lng IS NULL;
+UPDATE task SET uploaded = now() WHERE uploaded IS NULL;
+UPDATE task SET start = uploaded WHERE start IS NULL;
+UPDATE task SET stop = start WHERE stop IS NULL;
+UPDATE task SET initial_img_id = 0 WHERE initial_img_id IS NULL;
+UPDATE task SET likes = 0 WHERE likes IS NULL;
+UPDATE task SET num_submissions = 0 WHERE num_submissions IS NULL;
+
+UPDATE img SET uploaded = now() WHERE uploaded IS NULL;
+UPDATE img SET caption = '' WHERE caption IS NULL;
+-- Images uploaded before their task is created use NULL rather than 0
+UPDATE img SET task_id = NULL WHERE task_id NOT IN (SELECT id FROM task);
+
+ALTER SEQUENCE task_id OWNED BY task.id;
+ALTER TABLE task
+	ADD PRIMARY KEY (id),
+	DROP CONSTRAINT IF EXISTS task_id_key,
+	ALTER COLUMN title SET NOT NULL,
+	ALTER COLUMN title SET DEFAULT '',
+	ALTER COLUMN location_name SET NOT NULL,
+	ALTER COLUMN location_name SET DEFAULT '',
+	ALTER COLUMN location_address SET NOT NULL,
+	ALTER COLUMN location_address SET DEFAULT '',
+	ALTER COLUMN description SET NOT NULL,
+	ALTER COLUMN description SET DEFAULT '',
+	ALTER COLUMN lat SET NOT NULL,
+	ALTER COLUMN lng SET NOT NULL,
+	ALTER COLUMN uploaded SET NOT NULL,
+	ALTER COLUMN uploaded SET DEFAULT now(),
+	ALTER COLUMN start SET NOT NULL,
+	ALTER COLUMN stop SET NOT NULL,
+	ALTER COLUMN initial_img_id SET NOT NULL,
+	ALTER COLUMN initial_img_id SET DEFAULT 0,
+	ALTER COLUMN likes SET NOT NULL,
+	ALTER COLUMN likes SET DEFAULT 0,
+	ALTER COLUMN num_submissions SET NOT NULL,
+	ALTER COLUMN num_submissions SET DEFAULT 0;
+
+ALTER SEQUENCE img_id OWNED BY img.id;
+ALTER TABLE img
+	ADD PRIMARY KEY (id),
+	DROP CONSTRAINT IF EXISTS img_id_key,
+	ALTER COLUMN uploaded SET NOT NULL,
+	ALTER COLUMN uploaded SET DEFAULT now(),
+	ALTER COLUMN caption SET NOT NULL,
+	ALTER COLUMN caption SET DEFAULT '',
+	ADD CONSTRAINT img_task_id_fkey FOREIGN KEY (task_id) REFERENCES task (id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS img_task_id_idx ON img (task_id);
@@ -0,0 +1,8 @@
+ALTER TABLE task ADD COLUMN IF NOT EXISTS search tsvector
+	GENERATED ALWAYS AS (
+		setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+		setweight(to_tsvector('english', coalesce(location_name, '')), 'B') ||
+		setweight(to_tsvector('english', coalesce(description, '')), 'C')
+	) STORED;
+
+CREATE INDEX IF NOT EXISTS task_search_idx ON task USING GIN (search);
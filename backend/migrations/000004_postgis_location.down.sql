@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS task_stop_idx;
+DROP INDEX IF EXISTS task_location_idx;
+ALTER TABLE task DROP COLUMN IF EXISTS location;
@@ -0,0 +1,7 @@
+CREATE EXTENSION IF NOT EXISTS postgis;
+
+ALTER TABLE task ADD COLUMN IF NOT EXISTS location geography(Point, 4326)
+	GENERATED ALWAYS AS (ST_SetSRID(ST_MakePoint(lng, lat), 4326)::geography) STORED;
+
+CREATE INDEX IF NOT EXISTS task_location_idx ON task USING GIST (location);
+CREATE INDEX IF NOT EXISTS task_stop_idx ON task (stop);
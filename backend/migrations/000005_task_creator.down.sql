@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS task_start_idx;
+DROP INDEX IF EXISTS task_creator_idx;
+ALTER TABLE task DROP COLUMN IF EXISTS creator;
@@ -0,0 +1,4 @@
+ALTER TABLE task ADD COLUMN IF NOT EXISTS creator VARCHAR(256) NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS task_creator_idx ON task (creator);
+CREATE INDEX IF NOT EXISTS task_start_idx ON task (start);
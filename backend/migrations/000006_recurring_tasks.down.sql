@@ -0,0 +1,12 @@
+DROP INDEX IF EXISTS task_stale_occurrence_idx;
+DROP INDEX IF EXISTS task_occurrence_stop_idx;
+DROP INDEX IF EXISTS task_occurrence_start_idx;
+ALTER TABLE task
+	DROP COLUMN IF EXISTS occurrence_final,
+	DROP COLUMN IF EXISTS occurrence_stop,
+	DROP COLUMN IF EXISTS occurrence_start;
+DROP INDEX IF EXISTS img_task_occurrence_idx;
+ALTER TABLE img DROP COLUMN IF EXISTS occurrence_start;
+ALTER TABLE task
+	DROP COLUMN IF EXISTS duration,
+	DROP COLUMN IF EXISTS rrule;
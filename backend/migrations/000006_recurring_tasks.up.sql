@@ -0,0 +1,31 @@
+-- For recurring tasks start is the first occurrence and stop ends the series,
+-- each occurrence lasts duration seconds
+ALTER TABLE task
+	ADD COLUMN IF NOT EXISTS rrule TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS duration INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE img ADD COLUMN IF NOT EXISTS occurrence_start TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS img_task_occurrence_idx ON img (task_id, occurrence_start);
+
+-- Current or next occurrence of each task, its last one once the series is
+-- over. Tasks that don't recur have a single occurrence from start to stop
+ALTER TABLE task
+	ADD COLUMN IF NOT EXISTS occurrence_start TIMESTAMPTZ,
+	ADD COLUMN IF NOT EXISTS occurrence_stop TIMESTAMPTZ,
+	-- Set when there is no later occurrence to move to
+	ADD COLUMN IF NOT EXISTS occurrence_final BOOLEAN NOT NULL DEFAULT true;
+
+-- Recurring tasks start out at their first occurrence
+UPDATE task SET
+	occurrence_start = start,
+	occurrence_stop = CASE WHEN rrule = '' THEN stop ELSE start + make_interval(secs => duration) END,
+	occurrence_final = rrule = '';
+
+ALTER TABLE task
+	ALTER COLUMN occurrence_start SET NOT NULL,
+	ALTER COLUMN occurrence_stop SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS task_occurrence_start_idx ON task (occurrence_start);
+CREATE INDEX IF NOT EXISTS task_occurrence_stop_idx ON task (occurrence_stop);
+CREATE INDEX IF NOT EXISTS task_stale_occurrence_idx ON task (occurrence_stop) WHERE NOT occurrence_final;
@@ -0,0 +1,9 @@
+ALTER TABLE img
+	ALTER COLUMN occurrence_start TYPE TIMESTAMP USING occurrence_start AT TIME ZONE 'UTC',
+	ALTER COLUMN uploaded TYPE TIMESTAMP USING uploaded AT TIME ZONE 'UTC';
+
+ALTER TABLE task
+	DROP COLUMN IF EXISTS time_zone,
+	ALTER COLUMN stop TYPE TIMESTAMP USING stop AT TIME ZONE 'UTC',
+	ALTER COLUMN start TYPE TIMESTAMP USING start AT TIME ZONE 'UTC',
+	ALTER COLUMN uploaded TYPE TIMESTAMP USING uploaded AT TIME ZONE 'UTC';
@@ -0,0 +1,10 @@
+-- Existing timestamps were written from UTC Lambdas
+ALTER TABLE task
+	ALTER COLUMN uploaded TYPE TIMESTAMPTZ USING uploaded AT TIME ZONE 'UTC',
+	ALTER COLUMN start TYPE TIMESTAMPTZ USING start AT TIME ZONE 'UTC',
+	ALTER COLUMN stop TYPE TIMESTAMPTZ USING stop AT TIME ZONE 'UTC',
+	ADD COLUMN IF NOT EXISTS time_zone VARCHAR(64) NOT NULL DEFAULT 'UTC';
+
+ALTER TABLE img
+	ALTER COLUMN uploaded TYPE TIMESTAMPTZ USING uploaded AT TIME ZONE 'UTC',
+	ALTER COLUMN occurrence_start TYPE TIMESTAMPTZ USING occurrence_start AT TIME ZONE 'UTC';
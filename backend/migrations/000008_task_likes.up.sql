@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS task_like (
+	task_id INTEGER NOT NULL REFERENCES task (id) ON DELETE CASCADE,
+	user_id VARCHAR(256) NOT NULL,
+	created TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (task_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS task_like_user_id_idx ON task_like (user_id);
@@ -0,0 +1,3 @@
+ALTER TABLE task DROP COLUMN IF EXISTS num_comments;
+
+DROP TABLE IF EXISTS comment;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS comment (
+	id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	-- Comments on an image also carry the task of that image, if any
+	task_id INTEGER REFERENCES task (id) ON DELETE CASCADE,
+	img_id INTEGER REFERENCES img (id) ON DELETE CASCADE,
+	parent_id INTEGER REFERENCES comment (id) ON DELETE CASCADE,
+	author VARCHAR(256) NOT NULL,
+	body TEXT NOT NULL,
+	created TIMESTAMPTZ NOT NULL DEFAULT now(),
+	-- Deleted comments keep their row so replies stay threaded
+	deleted BOOLEAN NOT NULL DEFAULT false,
+	CHECK (task_id IS NOT NULL OR img_id IS NOT NULL)
+);
+
+CREATE INDEX IF NOT EXISTS comment_task_id_idx ON comment (task_id, created, id) WHERE img_id IS NULL;
+CREATE INDEX IF NOT EXISTS comment_img_id_idx ON comment (img_id, created, id);
+CREATE INDEX IF NOT EXISTS comment_parent_id_idx ON comment (parent_id, created, id);
+
+ALTER TABLE task ADD COLUMN IF NOT EXISTS num_comments INTEGER NOT NULL DEFAULT 0;
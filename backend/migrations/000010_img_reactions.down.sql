@@ -0,0 +1,6 @@
+ALTER TABLE task DROP COLUMN IF EXISTS top_img_id;
+
+DROP INDEX IF EXISTS img_task_id_num_reactions_idx;
+ALTER TABLE img DROP COLUMN IF EXISTS num_reactions;
+
+DROP TABLE IF EXISTS img_reaction;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS img_reaction (
+	img_id INTEGER NOT NULL REFERENCES img (id) ON DELETE CASCADE,
+	user_id VARCHAR(256) NOT NULL,
+	reaction VARCHAR(16) NOT NULL,
+	created TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (img_id, user_id, reaction)
+);
+
+ALTER TABLE img ADD COLUMN IF NOT EXISTS num_reactions INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS img_task_id_num_reactions_idx ON img (task_id, num_reactions DESC, uploaded, id);
+
+-- Submission with the most reactions, kept up to date as reactions change
+ALTER TABLE task ADD COLUMN IF NOT EXISTS top_img_id INTEGER REFERENCES img (id) ON DELETE SET NULL;
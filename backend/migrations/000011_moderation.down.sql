@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS moderation_log;
+DROP TABLE IF EXISTS banned_user;
+DROP TABLE IF EXISTS report;
+
+ALTER TABLE img DROP COLUMN IF EXISTS uploader;
+
+ALTER TABLE comment DROP COLUMN IF EXISTS hidden;
+ALTER TABLE img DROP COLUMN IF EXISTS hidden;
+ALTER TABLE task DROP COLUMN IF EXISTS hidden;
@@ -0,0 +1,40 @@
+-- Hidden content stays in the database but is left out of every listing
+ALTER TABLE task ADD COLUMN IF NOT EXISTS hidden BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE img ADD COLUMN IF NOT EXISTS hidden BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE comment ADD COLUMN IF NOT EXISTS hidden BOOLEAN NOT NULL DEFAULT false;
+
+ALTER TABLE img ADD COLUMN IF NOT EXISTS uploader VARCHAR(256) NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS report (
+	id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	target_type VARCHAR(16) NOT NULL CHECK (target_type IN ('task', 'img', 'comment')),
+	target_id INTEGER NOT NULL,
+	reporter VARCHAR(256) NOT NULL,
+	reason VARCHAR(32) NOT NULL,
+	details TEXT NOT NULL DEFAULT '',
+	created TIMESTAMPTZ NOT NULL DEFAULT now(),
+	-- open until a moderator acts on the target, then resolved or dismissed
+	status VARCHAR(16) NOT NULL DEFAULT 'open',
+	UNIQUE (target_type, target_id, reporter)
+);
+
+CREATE INDEX IF NOT EXISTS report_open_idx ON report (target_type, target_id) WHERE status = 'open';
+
+CREATE TABLE IF NOT EXISTS banned_user (
+	user_id VARCHAR(256) PRIMARY KEY,
+	banned_by VARCHAR(256) NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	created TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS moderation_log (
+	id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	moderator VARCHAR(256) NOT NULL,
+	action VARCHAR(16) NOT NULL,
+	target_type VARCHAR(16) NOT NULL,
+	target_id VARCHAR(256) NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	created TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS moderation_log_created_idx ON moderation_log (created);
@@ -0,0 +1,9 @@
+-- Fixed window request counters, one row per key and window
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limit (
+	key VARCHAR(512) NOT NULL,
+	window_start TIMESTAMPTZ NOT NULL,
+	count INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (key, window_start)
+);
+
+CREATE INDEX IF NOT EXISTS rate_limit_window_start_idx ON rate_limit (window_start);
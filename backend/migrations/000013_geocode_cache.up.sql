@@ -0,0 +1,9 @@
+-- Waypoint names by coordinates rounded to about 11 meters
+CREATE TABLE IF NOT EXISTS geocode_cache (
+	key VARCHAR(64) PRIMARY KEY,
+	name VARCHAR(256) NOT NULL,
+	address VARCHAR(256) NOT NULL,
+	created TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS geocode_cache_created_idx ON geocode_cache (created);
@@ -0,0 +1,6 @@
+ALTER TABLE task DROP COLUMN IF EXISTS place_id;
+
+TRUNCATE geocode_cache;
+ALTER TABLE geocode_cache DROP COLUMN IF EXISTS place;
+ALTER TABLE geocode_cache ADD COLUMN IF NOT EXISTS name VARCHAR(256) NOT NULL;
+ALTER TABLE geocode_cache ADD COLUMN IF NOT EXISTS address VARCHAR(256) NOT NULL;
@@ -0,0 +1,7 @@
+-- Cached entries become whole places, the old name only entries are dropped
+TRUNCATE geocode_cache;
+ALTER TABLE geocode_cache DROP COLUMN IF EXISTS name;
+ALTER TABLE geocode_cache DROP COLUMN IF EXISTS address;
+ALTER TABLE geocode_cache ADD COLUMN IF NOT EXISTS place JSONB NOT NULL;
+
+ALTER TABLE task ADD COLUMN IF NOT EXISTS place_id VARCHAR(256) NOT NULL DEFAULT '';
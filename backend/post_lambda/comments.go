@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/jackc/pgx/v5"
+)
+
+const maxCommentLength = 2000
+
+// A comment goes on a task or an image, or replies to another comment in
+// which case it joins the thread of that comment
+type CommentPost struct {
+	TaskId   *int   `json:"task_id"`
+	ImgId    *int   `json:"img_id"`
+	ParentId *int   `json:"parent_id"`
+	Body     string `json:"body"`
+}
+
+func missingUserResponse() events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: 400,
+		Body:       "Missing user: send an X-Device-Id header",
+	}
+}
+
+func createComment(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	author := getRequestUser(request)
+	if author == "" {
+		return missingUserResponse()
+	}
+
+	var post CommentPost
+	if err := json.Unmarshal([]byte(request.Body), &post); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid JSON body",
+		}
+	}
+
+	post.Body = strings.TrimSpace(post.Body)
+	if post.Body == "" || utf8.RuneCountInString(post.Body) > maxCommentLength {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf("Invalid body: must be between 1 and %d characters", maxCommentLength),
+		}
+	}
+
+	var task_id, img_id *int
+	var err error
+	switch {
+	case post.ParentId != nil:
+		var parent_removed bool
+		// Threads under a hidden task or image take no more replies
+		err = dbConn.QueryRow(context.Background(), `
+			SELECT task_id, img_id, deleted OR hidden
+				OR EXISTS (SELECT 1 FROM task WHERE task.id = comment.task_id AND task.hidden)
+				OR EXISTS (SELECT 1 FROM img WHERE img.id = comment.img_id AND img.hidden)
+				FROM comment WHERE id = $1
+		`, *post.ParentId).Scan(&task_id, &img_id, &parent_removed)
+		if err == nil && parent_removed {
+			err = pgx.ErrNoRows
+		}
+		if err == nil && ((post.TaskId != nil && (task_id == nil || *post.TaskId != *task_id)) ||
+			(post.ImgId != nil && (img_id == nil || *post.ImgId != *img_id))) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       "Invalid parent_id: belongs to a different task or image",
+			}
+		}
+	case post.ImgId != nil && post.TaskId == nil:
+		img_id = post.ImgId
+		err = dbConn.QueryRow(context.Background(), `
+			SELECT task_id FROM img WHERE id = $1 AND NOT hidden
+				AND NOT EXISTS (SELECT 1 FROM task WHERE task.id = img.task_id AND task.hidden)
+		`, *img_id).Scan(&task_id)
+	case post.TaskId != nil && post.ImgId == nil:
+		task_id = post.TaskId
+		err = dbConn.QueryRow(context.Background(), `
+			SELECT id FROM task WHERE id = $1 AND NOT hidden
+		`, *task_id).Scan(new(int))
+	default:
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid JSON body: need one of task_id, img_id or parent_id",
+		}
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       "Not found",
+		}
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+
+	tx, err := dbConn.Begin(context.Background())
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+	defer tx.Rollback(context.Background())
+
+	var comment_id int
+	err = tx.QueryRow(context.Background(), `
+		INSERT INTO comment (task_id, img_id, parent_id, author, body)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, task_id, img_id, post.ParentId, author, post.Body).Scan(&comment_id)
+	if err == nil && task_id != nil {
+		// Task counts include the comments on its images
+		_, err = tx.Exec(context.Background(), `
+			UPDATE task SET num_comments = num_comments + 1 WHERE id = $1
+		`, *task_id)
+	}
+	if err == nil {
+		err = tx.Commit(context.Background())
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       fmt.Sprintf("{\"id\":%d}", comment_id),
+	}
+}
+
+// Delete one of the caller's comments. The row stays behind with an empty
+// body so replies keep their place in the thread
+func deleteComment(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	author := getRequestUser(request)
+	if author == "" {
+		return missingUserResponse()
+	}
+
+	comment_id_str, exists := request.QueryStringParameters["id"]
+	if !exists {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Missing required parameter: id",
+		}
+	}
+
+	comment_id, err := strconv.Atoi(comment_id_str)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid required parameter: id",
+		}
+	}
+
+	tx, err := dbConn.Begin(context.Background())
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+	defer tx.Rollback(context.Background())
+
+	var comment_author string
+	var task_id *int
+	var hidden bool
+	err = tx.QueryRow(context.Background(), `
+		SELECT author, task_id, hidden
+			OR EXISTS (SELECT 1 FROM img WHERE img.id = comment.img_id AND img.hidden)
+			FROM comment WHERE id = $1 AND NOT deleted FOR UPDATE
+	`, comment_id).Scan(&comment_author, &task_id, &hidden)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       "Not found",
+		}
+	}
+	if err == nil && comment_author != author {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 403,
+			Body:       "Forbidden",
+		}
+	}
+
+	if err == nil {
+		_, err = tx.Exec(context.Background(), `
+			UPDATE comment SET deleted = true, body = '' WHERE id = $1
+		`, comment_id)
+	}
+	// Hidden comments, and those on hidden images, were already taken out
+	// of the count
+	if err == nil && task_id != nil && !hidden {
+		_, err = tx.Exec(context.Background(), `
+			UPDATE task SET num_comments = num_comments - 1 WHERE id = $1
+		`, *task_id)
+	}
+	if err == nil {
+		err = tx.Commit(context.Background())
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       "{}",
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/jackc/pgx/v5"
+)
+
+// Fields a creator may change after posting, nil leaves a field as is
+type TaskEditPost struct {
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+}
+
+// Let the creator of a task fix its title or description. The new text is
+// screened like on creation and can put the task on hold
+func editTask(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	user := getRequestUser(request)
+	if user == "" {
+		return missingUserResponse()
+	}
+
+	task_id_str, exists := request.QueryStringParameters["task_id"]
+	if !exists {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Missing required parameter: task_id",
+		}
+	}
+
+	task_id, err := strconv.Atoi(task_id_str)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid required parameter: task_id",
+		}
+	}
+
+	var post TaskEditPost
+	if err := json.Unmarshal([]byte(request.Body), &post); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid JSON body",
+		}
+	}
+	if post.Title != nil {
+		if err := validateTitle(*post.Title); err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf("Invalid %v", err),
+			}
+		}
+	}
+
+	var text ScreenText
+	var creator string
+	err = dbConn.QueryRow(context.Background(), `
+		SELECT title, description, creator FROM task WHERE id = $1
+	`, task_id).Scan(&text.Title, &text.Description, &creator)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       "Not found",
+		}
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+	if creator != user {
+		return forbiddenResponse()
+	}
+
+	if post.Title != nil {
+		text.Title = *post.Title
+	}
+	if post.Description != nil {
+		text.Description = *post.Description
+	}
+
+	// Screened before any row is locked, classifiers can take seconds. Only
+	// the edited fields are written, the others were screened when they
+	// were last set
+	screening := screenText(text)
+
+	tx, err := dbConn.Begin(context.Background())
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), `
+		UPDATE task SET title = COALESCE($2, title), description = COALESCE($3, description)
+			WHERE id = $1
+	`, task_id, post.Title, post.Description)
+	if err == nil && screening.Hold {
+		err = holdTask(tx, task_id, screening)
+	}
+	if err == nil {
+		err = tx.Commit(context.Background())
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       fmt.Sprintf("{\"id\":%d,\"held\":%t}", task_id, screening.Hold),
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Coordinates are rounded to 4 decimals, about 11 meters, so dragging a pin
+// around the same spot hits the same entry
+const geocodeCacheFormat = "%.4f,%.4f"
+
+const geocodeCacheTTL = 30 * 24 * time.Hour
+
+// Cities and countries are cached on a coarser grid, about 1 km, so pins
+// nearby share one reverse geocoding call
+const cityCacheFormat = "city:%.2f,%.2f"
+
+func geocodeCacheKey(lat, lng float64) string {
+	return fmt.Sprintf(geocodeCacheFormat, lat, lng)
+}
+
+// Place cached for a key, if there is one younger than the TTL
+func cachedPlace(key string) (Place, bool, error) {
+	var place Place
+	err := dbConn.QueryRow(context.Background(), `
+		SELECT place FROM geocode_cache WHERE key = $1 AND created > $2
+	`, key, time.Now().Add(-geocodeCacheTTL)).Scan(&place)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Place{}, false, nil
+	}
+	if err != nil {
+		return Place{}, false, err
+	}
+
+	return place, true, nil
+}
+
+func storePlace(key string, place Place) error {
+	// Expired entries are cleared now and then rather than on every store
+	if rand.Intn(100) == 0 {
+		_, err := dbConn.Exec(context.Background(), `
+			DELETE FROM geocode_cache WHERE created < $1
+		`, time.Now().Add(-geocodeCacheTTL))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := dbConn.Exec(context.Background(), `
+		INSERT INTO geocode_cache (key, place) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET place = $2, created = now()
+	`, key, place)
+
+	return err
+}
+
+// Best place near the pin, from the cache shared by every Lambda when
+// possible. Cache failures fall back to the Places API
+func findClosestPlace(lat, lng float64) (Place, error) {
+	if !config.Features.GeocodeCache {
+		return lookupClosestPlace(lat, lng)
+	}
+
+	key := geocodeCacheKey(lat, lng)
+	place, found, err := cachedPlace(key)
+	if err != nil {
+		slog.Warn("geocode cache lookup failed", "error", err)
+	}
+	if found {
+		return place, nil
+	}
+
+	place, err = lookupClosestPlace(lat, lng)
+	if err != nil {
+		return Place{}, err
+	}
+
+	if err := storePlace(key, place); err != nil {
+		slog.Warn("geocode cache store failed", "error", err)
+	}
+
+	return place, nil
+}
+
+// City and country of the pin, from the cache shared by every Lambda when
+// possible. They are stored as a place with only those two fields
+func findCityAndCountry(lat, lng float64) (string, string, error) {
+	if !config.Features.GeocodeCache {
+		return lookupCityAndCountry(lat, lng)
+	}
+
+	key := fmt.Sprintf(cityCacheFormat, lat, lng)
+	cached, found, err := cachedPlace(key)
+	if err != nil {
+		slog.Warn("geocode cache lookup failed", "error", err)
+	}
+	if found {
+		return cached.City, cached.Country, nil
+	}
+
+	city, country, err := lookupCityAndCountry(lat, lng)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := storePlace(key, Place{Types: []string{}, City: city, Country: country}); err != nil {
+		slog.Warn("geocode cache store failed", "error", err)
+	}
+
+	return city, country, nil
+}
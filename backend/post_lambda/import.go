@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"golang.org/x/time/rate"
+)
+
+// Imports through the API have to finish within the 30 s timeout terraform
+// gives the post Lambda, and API Gateway gives up after 29 s. Geocoding every
+// row at 5 calls a second takes 20 s
+const maxImportRows = 100
+
+// Places API calls made for rows without a location name
+var geocodeLimiter = rate.NewLimiter(rate.Limit(5), 1)
+
+// A task to import, as a CSV row or GeoJSON feature. The location name and
+// address are looked up when left empty
+type ImportTask struct {
+	TaskPost
+	LocationName    string `json:"location_name"`
+	LocationAddress string `json:"location_address"`
+}
+
+type ImportRowRet struct {
+	// 1 based, counting data rows or features
+	Row          int    `json:"row"`
+	Title        string `json:"title,omitempty"`
+	Ok           bool   `json:"ok"`
+	Id           int    `json:"id,omitempty"`
+	LocationName string `json:"location_name,omitempty"`
+	// The location was looked up, or would be on a commit. Dry runs don't
+	// spend Places API calls
+	Geocoded bool `json:"geocoded,omitempty"`
+	// Screening put the task in the moderation queue, or would on a commit
+	Held  bool   `json:"held,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type ImportRet struct {
+	DryRun    bool           `json:"dry_run"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Rows      []ImportRowRet `json:"rows"`
+}
+
+type importFeature struct {
+	Geometry struct {
+		Type        string    `json:"type"`
+		Coordinates []float64 `json:"coordinates"`
+	} `json:"geometry"`
+	Properties json.RawMessage `json:"properties"`
+}
+
+// Rows that could not even be parsed are reported with their error
+type parsedImportTask struct {
+	Task ImportTask
+	Err  error
+}
+
+// Parse CSV with a header row naming the ImportTask fields, in any order
+func parseImportCSV(r io.Reader) ([]parsedImportTask, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read header: %v", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"title", "lat", "lng"} {
+		if _, exists := columns[name]; !exists {
+			return nil, fmt.Errorf("missing column: %s", name)
+		}
+	}
+
+	tasks := []parsedImportTask{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if _, is_parse_error := err.(*csv.ParseError); !is_parse_error {
+				return nil, err
+			}
+			tasks = append(tasks, parsedImportTask{Err: err})
+			continue
+		}
+
+		field := func(name string) string {
+			if i, exists := columns[name]; exists && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		var task ImportTask
+		var parse_err error
+		parseFloat := func(name string) float64 {
+			value, err := strconv.ParseFloat(field(name), 64)
+			if err != nil && parse_err == nil {
+				parse_err = fmt.Errorf("invalid %s: %q", name, field(name))
+			}
+			return value
+		}
+		parseInt := func(name string) int64 {
+			if field(name) == "" {
+				return 0
+			}
+			value, err := strconv.ParseInt(field(name), 10, 64)
+			if err != nil && parse_err == nil {
+				parse_err = fmt.Errorf("invalid %s: %q", name, field(name))
+			}
+			return value
+		}
+
+		task.Title = field("title")
+		task.Description = field("description")
+		task.Lat = parseFloat("lat")
+		task.Lng = parseFloat("lng")
+		task.Start = parseInt("start")
+		task.Stop = parseInt("stop")
+		task.StartLocal = field("start_local")
+		task.StopLocal = field("stop_local")
+		task.RRule = field("rrule")
+		task.Duration = parseInt("duration")
+		task.LocationName = field("location_name")
+		task.LocationAddress = field("location_address")
+
+		tasks = append(tasks, parsedImportTask{Task: task, Err: parse_err})
+	}
+
+	return tasks, nil
+}
+
+// Parse a GeoJSON FeatureCollection of points whose properties name the
+// ImportTask fields
+func parseImportGeoJSON(r io.Reader) ([]parsedImportTask, error) {
+	var collection struct {
+		Type     string          `json:"type"`
+		Features []importFeature `json:"features"`
+	}
+	if err := json.NewDecoder(r).Decode(&collection); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %v", err)
+	}
+	if collection.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("expected a FeatureCollection")
+	}
+
+	tasks := []parsedImportTask{}
+	for _, feature := range collection.Features {
+		var task ImportTask
+		if len(feature.Properties) > 0 && string(feature.Properties) != "null" {
+			if err := json.Unmarshal(feature.Properties, &task); err != nil {
+				tasks = append(tasks, parsedImportTask{Err: fmt.Errorf("invalid properties: %v", err)})
+				continue
+			}
+		}
+
+		if feature.Geometry.Type != "Point" || len(feature.Geometry.Coordinates) < 2 {
+			tasks = append(tasks, parsedImportTask{Task: task, Err: fmt.Errorf("geometry must be a Point")})
+			continue
+		}
+		task.Lng = feature.Geometry.Coordinates[0]
+		task.Lat = feature.Geometry.Coordinates[1]
+
+		tasks = append(tasks, parsedImportTask{Task: task})
+	}
+
+	return tasks, nil
+}
+
+func parseImport(format string, r io.Reader) ([]parsedImportTask, error) {
+	switch format {
+	case "csv":
+		return parseImportCSV(r)
+	case "geojson":
+		return parseImportGeoJSON(r)
+	default:
+		return nil, fmt.Errorf("unknown format %q, must be csv or geojson", format)
+	}
+}
+
+// Validate, geocode and, unless this is a dry run, insert each task. Rows are
+// independent, one failing doesn't stop the others
+func importTasks(tasks []parsedImportTask, creator string, dry_run bool) ImportRet {
+	ret := ImportRet{
+		DryRun: dry_run,
+		Rows:   []ImportRowRet{},
+	}
+
+	for i, parsed := range tasks {
+		task := parsed.Task
+		row := ImportRowRet{
+			Row:   i + 1,
+			Title: task.Title,
+		}
+
+		err := parsed.Err
+		if err == nil {
+			err = importTask(task, creator, dry_run, &row)
+		}
+
+		if err != nil {
+			row.Error = err.Error()
+			ret.Failed++
+		} else {
+			row.Ok = true
+			ret.Succeeded++
+		}
+		ret.Rows = append(ret.Rows, row)
+	}
+
+	return ret
+}
+
+// Fill in row for a single task, inserting it unless this is a dry run
+func importTask(task ImportTask, creator string, dry_run bool, row *ImportRowRet) error {
+	start, stop, time_zone, err := validateTaskPost(task.TaskPost)
+	if err != nil {
+		return fmt.Errorf("invalid %v", err)
+	}
+
+	// Imported tasks are screened like posted ones, held ones still count
+	// as imported
+	screening := screenText(ScreenText{Title: task.Title, Description: task.Description})
+	row.Held = screening.Hold
+
+	place := Place{Name: task.LocationName, FormattedAddress: task.LocationAddress}
+	if place.Name == "" {
+		row.Geocoded = true
+		if dry_run {
+			return nil
+		}
+
+		if err := geocodeLimiter.Wait(context.Background()); err != nil {
+			return err
+		}
+
+		place, err = findClosestPlace(task.Lat, task.Lng)
+		if err != nil {
+			return fmt.Errorf("places lookup failed: %s", scrubSecrets(err.Error()))
+		}
+	}
+	row.LocationName = place.Name
+
+	if dry_run {
+		return nil
+	}
+
+	tx, err := dbConn.Begin(context.Background())
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	row.Id, err = insertTask(tx, task.TaskPost, place, start, stop, time_zone, creator)
+	if err == nil && screening.Hold {
+		err = holdTask(tx, row.Id, screening)
+	}
+	if err == nil {
+		err = tx.Commit(context.Background())
+	}
+	if err != nil {
+		row.Id = 0
+		return fmt.Errorf("database error: %v", err)
+	}
+
+	return nil
+}
+
+// Imports are admin only, authorized by the shared ADMIN_TOKEN
+func isAdminRequest(request events.APIGatewayProxyRequest) bool {
+	admin_token := config.AdminToken
+	if admin_token == "" {
+		return false
+	}
+
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, "X-Admin-Token") {
+			return subtle.ConstantTimeCompare([]byte(value), []byte(admin_token)) == 1
+		}
+	}
+
+	return false
+}
+
+func importTasksRequest(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if !isAdminRequest(request) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 403,
+			Body:       "Forbidden",
+		}
+	}
+
+	format := request.QueryStringParameters["format"]
+	dry_run := true
+	switch request.QueryStringParameters["mode"] {
+	case "", "dry_run":
+	case "commit":
+		dry_run = false
+	default:
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid parameters: mode (must be dry_run or commit)",
+		}
+	}
+
+	body := request.Body
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       "Invalid base64 body",
+			}
+		}
+		body = string(decoded)
+	}
+
+	tasks, err := parseImport(format, strings.NewReader(body))
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf("Invalid import: %v", err),
+		}
+	}
+	if len(tasks) > maxImportRows {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf("Invalid import: more than %d rows, use the import command instead", maxImportRows),
+		}
+	}
+
+	ret_json, err := json.Marshal(importTasks(tasks, getRequestUser(request), dry_run))
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("JSON marshalling error: %v", err),
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       string(ret_json),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
+
+// Import from a file on the command line:
+//
+//	post_lambda import [-commit] [-format csv|geojson] [-creator name] file
+//
+// Runs as a dry run unless -commit is given and prints the report as JSON.
+// Returns the process exit code
+func runImportCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	commit := flags.Bool("commit", false, "insert the tasks instead of only validating them")
+	format := flags.String("format", "", "csv or geojson, guessed from the file extension by default")
+	creator := flags.String("creator", "import", "creator recorded on the imported tasks")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: import [-commit] [-format csv|geojson] [-creator name] file")
+		return 2
+	}
+
+	path := flags.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+		if *format == "json" {
+			*format = "geojson"
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+
+	tasks, err := parseImport(*format, file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid import: %v\n", err)
+		return 1
+	}
+
+	ret := importTasks(tasks, *creator, !*commit)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(ret); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if ret.Failed > 0 {
+		return 1
+	}
+	return 0
+}
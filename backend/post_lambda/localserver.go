@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Translate an HTTP request into the event API Gateway would send
+func localProxyRequest(r *http.Request) (events.APIGatewayProxyRequest, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return events.APIGatewayProxyRequest{}, err
+	}
+
+	request_id := make([]byte, 16)
+	rand.Read(request_id)
+	source_ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:                      r.Method,
+		Path:                            r.URL.Path,
+		Headers:                         map[string]string{},
+		MultiValueHeaders:               r.Header,
+		QueryStringParameters:           map[string]string{},
+		MultiValueQueryStringParameters: r.URL.Query(),
+		RequestContext: events.APIGatewayProxyRequestContext{
+			RequestID: hex.EncodeToString(request_id),
+			Identity: events.APIGatewayRequestIdentity{
+				SourceIP: source_ip,
+			},
+		},
+	}
+	for key, values := range r.Header {
+		request.Headers[key] = values[0]
+	}
+	for key, values := range r.URL.Query() {
+		request.QueryStringParameters[key] = values[0]
+	}
+
+	// API Gateway base64 encodes binary bodies such as uploaded images
+	if utf8.Valid(body) {
+		request.Body = string(body)
+	} else {
+		request.Body = base64.StdEncoding.EncodeToString(body)
+		request.IsBase64Encoded = true
+	}
+
+	return request, nil
+}
+
+// Serve the Lambda handler over plain HTTP for local development, with the
+// metrics in the Prometheus format at /metrics
+func runLocalServer(next func(events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHTTPHandler)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		request, err := localProxyRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		response, err := next(request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		body := []byte(response.Body)
+		if response.IsBase64Encoded {
+			body, err = base64.StdEncoding.DecodeString(response.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		for key, value := range response.Headers {
+			w.Header().Set(key, value)
+		}
+		for key, values := range response.MultiValueHeaders {
+			for _, value := range values {
+				w.Header().Add(key, value)
+			}
+		}
+		w.WriteHeader(response.StatusCode)
+		w.Write(body)
+	})
+
+	slog.Info("serving locally", "addr", config.LocalAddr)
+	return http.ListenAndServe(config.LocalAddr, mux)
+}
@@ -5,25 +5,32 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+	_ "time/tzdata"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/joho/godotenv"
+	"github.com/ringsaturn/tzf"
 	"googlemaps.github.io/maps"
-	"honnef.co/go/spew"
 )
 
 var mapsClient *maps.Client
 var s3Client *s3.S3
 var dbConn *pgxpool.Pool
+var tzFinder tzf.F
 
 type TaskRet struct {
 	Id           int     `json:"id"`
@@ -38,58 +45,70 @@ type TaskRet struct {
 	Likes        int     `json:"likes"`
 }
 
-func findClosestWaypoint(lat, lng float64) (string, string, error) {
-	// Define the request for Nearby Search
-	req := &maps.NearbySearchRequest{
-		Location: &maps.LatLng{
-			Lat: lat,
-			Lng: lng,
-		},
-		Radius: 5000, // Search within 5km radius
+// Create the clients from the environment. Called from main, so tests of
+// the handlers' helpers run without any of it
+func setup() {
+	var err error
+	config, err = loadConfig()
+	if err != nil {
+		panic(err)
 	}
+	initLogger()
 
-	// Execute the Nearby Search request
-	resp, err := mapsClient.NearbySearch(context.Background(), req)
+	// Initialize Google Maps client
+	mapsClient, err = maps.NewClient(maps.WithAPIKey(config.GoogleMapsKey))
 	if err != nil {
-		return "", "", fmt.Errorf("failed to perform nearby search: %w", err)
+		panic(fmt.Sprintf("Failed to create Google Maps client: %v", err))
 	}
 
-	// Check if there are any results
-	if len(resp.Results) == 0 {
-		return "", "", fmt.Errorf("no waypoints found near the specified location")
+	aws_config := &aws.Config{
+		Region: aws.String(config.S3Region),
 	}
+	if config.AWSAccessKeyId != "" {
+		aws_config.Credentials = credentials.NewStaticCredentials(config.AWSAccessKeyId, config.AWSSecretAccessKey, "")
+	}
+	s3Client = s3.New(session.Must(session.NewSession(aws_config)))
 
-	// Extract the name and address of the closest waypoint
-	closest := resp.Results[0]
-
-	return closest.Name, closest.FormattedAddress, nil
-}
+	initRateLimiter()
 
-func init() {
-	// Load environment variables
-	err := godotenv.Load()
+	err = initTextScreeners()
 	if err != nil {
-		fmt.Println("Error loading .env file, proceeding without it...")
+		panic(fmt.Sprintf("Failed to set up text screening: %v", err))
 	}
 
-	// Initialize Google Maps client
-	mapsClient, err = maps.NewClient(maps.WithAPIKey(os.Getenv("GOOGLE_MAPS_KEY")))
+	// Offline time zone boundaries, so no API call is needed per task
+	tzFinder, err = tzf.NewDefaultFinder()
 	if err != nil {
-		panic(fmt.Sprintf("Failed to create Google Maps client: %v", err))
+		panic(fmt.Sprintf("Failed to load time zone boundaries: %v", err))
 	}
 
-	s3Client = s3.New(session.Must(session.NewSession()))
-
-	pgx_config, err := pgxpool.ParseConfig(os.Getenv("DATABASE_URL"))
+	pgx_config, err := pgxpool.ParseConfig(config.DatabaseURL)
 	if err != nil {
-		panic(fmt.Sprintf("Invalid databse URL: %v", os.Getenv("DATABASE_URL")))
+		panic(fmt.Sprintf("Invalid database URL: %v", err))
 	}
-	pgx_config.MaxConns = 32
-	pgx_config.ConnConfig.ConnectTimeout = 10 * time.Second
+	pgx_config.MaxConns = int32(config.DBMaxConns)
+	pgx_config.ConnConfig.ConnectTimeout = config.DBConnectTimeout
+	pgx_config.ConnConfig.Tracer = dbMetricsTracer{}
 	dbConn, err = pgxpool.NewWithConfig(context.Background(), pgx_config)
 	if err != nil {
-		panic(fmt.Sprintf("Could not connect to database: %v", os.Getenv("DATABASE_URL")))
+		panic(fmt.Sprintf("Could not connect to database: %v", err))
+	}
+}
+
+// Identify the caller: the authorizer principal when the API sits behind one,
+// otherwise the anonymous device id the client sends along
+func getRequestUser(request events.APIGatewayProxyRequest) string {
+	if principal, ok := request.RequestContext.Authorizer["principalId"].(string); ok && principal != "" {
+		return principal
 	}
+
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, "X-Device-Id") && value != "" {
+			return "device:" + value
+		}
+	}
+
+	return ""
 }
 
 type TaskPost struct {
@@ -100,6 +119,165 @@ type TaskPost struct {
 	Start        int64   `json:"start"`
 	Stop         int64   `json:"stop"`
 	InitialImgId int     `json:"initial_img_id"`
+	// Optional iCalendar RRULE making the task repeat every Duration seconds
+	// from Start until Stop
+	RRule    string `json:"rrule"`
+	Duration int64  `json:"duration"`
+	// Optional wall clock times such as "2024-06-01T09:00" in the time zone
+	// of the task location, replacing Start and Stop
+	StartLocal string `json:"start_local"`
+	StopLocal  string `json:"stop_local"`
+}
+
+// Time zone of a location, UTC where no zone is defined such as at sea
+func findTimeZone(lat, lng float64) string {
+	time_zone := tzFinder.GetTimezoneName(lng, lat)
+	if time_zone == "" {
+		return "UTC"
+	}
+
+	return time_zone
+}
+
+// Parse an ISO-8601 local time without offset in the given zone
+func parseLocalTime(value string, location *time.Location) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04"} {
+		if parsed, err := time.ParseInLocation(layout, value, location); err == nil {
+			return parsed, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("expected YYYY-MM-DDTHH:MM[:SS], got %q", value)
+}
+
+// Titles are stored as VARCHAR(256)
+const maxTitleLength = 256
+
+// Check a task title, on creation, import and edit alike
+func validateTitle(title string) error {
+	if strings.TrimSpace(title) == "" || utf8.RuneCountInString(title) > maxTitleLength {
+		return fmt.Errorf("title: must be between 1 and %d characters", maxTitleLength)
+	}
+
+	return nil
+}
+
+// Validate a new task, posted or imported, and resolve its start, stop and
+// time zone
+func validateTaskPost(post TaskPost) (time.Time, time.Time, string, error) {
+	if err := validateTitle(post.Title); err != nil {
+		return time.Time{}, time.Time{}, "", err
+	}
+	if post.Lat < -90 || post.Lat > 90 || post.Lng < -180 || post.Lng > 180 {
+		return time.Time{}, time.Time{}, "", fmt.Errorf("lat, lng: out of range")
+	}
+	if post.Start == 0 && post.StartLocal == "" {
+		return time.Time{}, time.Time{}, "", fmt.Errorf("start: missing start or start_local")
+	}
+	if post.Stop == 0 && post.StopLocal == "" {
+		return time.Time{}, time.Time{}, "", fmt.Errorf("stop: missing stop or stop_local")
+	}
+
+	time_zone := findTimeZone(post.Lat, post.Lng)
+	location, err := time.LoadLocation(time_zone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	start := time.Unix(post.Start, 0)
+	if post.StartLocal != "" {
+		start, err = parseLocalTime(post.StartLocal, location)
+		if err != nil {
+			return start, start, time_zone, fmt.Errorf("start_local: %v", err)
+		}
+	}
+
+	stop := time.Unix(post.Stop, 0)
+	if post.StopLocal != "" {
+		stop, err = parseLocalTime(post.StopLocal, location)
+		if err != nil {
+			return start, stop, time_zone, fmt.Errorf("stop_local: %v", err)
+		}
+	}
+	if !stop.After(start) {
+		return start, stop, time_zone, fmt.Errorf("stop: must be after start")
+	}
+
+	if post.RRule != "" {
+		if err := validateRecurrence(post.RRule, start.In(location), stop.In(location)); err != nil {
+			return start, stop, time_zone, fmt.Errorf("rrule: %v", err)
+		}
+		if post.Duration <= 0 {
+			return start, stop, time_zone, fmt.Errorf("duration: recurring tasks need a positive duration")
+		}
+	}
+
+	return start, stop, time_zone, nil
+}
+
+// Either the pool or a transaction
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func insertTask(db rowQuerier, post TaskPost, place Place,
+	start time.Time, stop time.Time, time_zone string, creator string) (int, error) {
+	occurrence_start, occurrence_stop, occurrence_final, err := taskOccurrence(post.RRule, post.Duration, start, stop, time_zone)
+	if err != nil {
+		return 0, err
+	}
+
+	var task_id int
+	err = db.QueryRow(context.Background(), `
+		INSERT INTO task (title, location_name, location_address, place_id,
+		description, lat, lng, uploaded, start, stop,
+		initial_img_id, likes, creator, rrule, duration, time_zone,
+		occurrence_start, occurrence_stop, occurrence_final)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, 0, $12, $13, $14, $15, $16, $17, $18)
+		RETURNING id
+	`,
+		post.Title,
+		place.Name,
+		place.FormattedAddress,
+		place.PlaceId,
+		post.Description,
+		post.Lat,
+		post.Lng,
+		time.Now(),
+		start,
+		stop,
+		post.InitialImgId,
+		creator,
+		post.RRule,
+		post.Duration,
+		time_zone,
+		occurrence_start,
+		occurrence_stop,
+		occurrence_final,
+	).Scan(&task_id)
+
+	return task_id, err
+}
+
+// Request types the handler serves, the only ones given their own metrics.
+// Keep in step with its switch
+var knownRequestTypes = map[string]bool{
+	"create_task":         true,
+	"edit_task":           true,
+	"import_tasks":        true,
+	"upload_image":        true,
+	"update_image":        true,
+	"like":                true,
+	"create_comment":      true,
+	"delete_comment":      true,
+	"react":               true,
+	"unreact":             true,
+	"report":              true,
+	"get_reports":         true,
+	"moderate":            true,
+	"get_moderation_log":  true,
+	"get_presigned_url":   true,
+	"refresh_occurrences": true,
 }
 
 func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
@@ -111,11 +289,29 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 		}, nil
 	}
 
+	// Banned users can still browse but not post anything
+	if user := getRequestUser(request); user != "" && !isAdminRequest(request) {
+		banned, err := isBannedUser(user)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       fmt.Sprintf("Database error: %v", err),
+			}, nil
+		}
+		if banned {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 403,
+				Body:       "Forbidden: user is banned",
+			}, nil
+		}
+	}
+
 	switch request_type {
 	case "create_task":
 		var task_id int
 
 		body := request.Body
+		creator := getRequestUser(request)
 
 		var request TaskPost
 		err := json.Unmarshal([]byte(body), &request)
@@ -126,33 +322,40 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 			}, nil
 		}
 
-		// Geolocate name and address
-		location_name, location_address, err := findClosestWaypoint(request.Lat, request.Lng)
+		start, stop, time_zone, err := validateTaskPost(request)
 		if err != nil {
 			return events.APIGatewayProxyResponse{
 				StatusCode: 400,
-				Body:       fmt.Sprintf("Could not find closest endpoint: %v", err),
+				Body:       fmt.Sprintf("Invalid %v", err),
 			}, nil
 		}
 
-		err = dbConn.QueryRow(context.Background(), `
-			INSERT INTO task (title, location_name, location_address,
-			description, lat, lng, uploaded, start, stop,
-			initial_img_id, likes)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 0)
-			RETURNING id
-		`,
-			request.Title,
-			location_name,
-			location_address,
-			request.Description,
-			request.Lat,
-			request.Lng,
-			time.Now(),
-			time.Unix(request.Start, 0),
-			time.Unix(request.Stop, 0),
-			request.InitialImgId,
-		).Scan(&task_id)
+		// Held tasks go to the moderation queue instead of the map. They are
+		// still geocoded, moderators review them with their place and an
+		// approved task shows up on the map without another lookup
+		screening := screenText(ScreenText{Title: request.Title, Description: request.Description})
+
+		// Geolocate name and address
+		place, err := findClosestPlace(request.Lat, request.Lng)
+		if err != nil {
+			slog.Error("places lookup failed", "error", err)
+			return events.APIGatewayProxyResponse{
+				StatusCode: 502,
+				Body:       "Places lookup failed",
+			}, nil
+		}
+
+		tx, err := dbConn.Begin(context.Background())
+		if err == nil {
+			defer tx.Rollback(context.Background())
+			task_id, err = insertTask(tx, request, place, start, stop, time_zone, creator)
+		}
+		if err == nil && screening.Hold {
+			err = holdTask(tx, task_id, screening)
+		}
+		if err == nil {
+			err = tx.Commit(context.Background())
+		}
 		if err != nil {
 			return events.APIGatewayProxyResponse{
 				StatusCode: 500,
@@ -162,8 +365,12 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 
 		return events.APIGatewayProxyResponse{
 			StatusCode: 200,
-			Body:       fmt.Sprintf("{\"id\":%d}", task_id),
+			Body:       fmt.Sprintf("{\"id\":%d,\"held\":%t}", task_id, screening.Hold),
 		}, nil
+	case "edit_task":
+		return editTask(request), nil
+	case "import_tasks":
+		return importTasksRequest(request), nil
 	case "upload_image":
 		if request.Body == "" {
 			return events.APIGatewayProxyResponse{
@@ -172,33 +379,53 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 			}, nil
 		}
 
-		taskIdStr, exists := request.QueryStringParameters["task_id"]
-		if !exists {
-			taskIdStr = "0"
-		}
 		caption, exists := request.QueryStringParameters["caption"]
 		if !exists {
 			caption = ""
 		}
 
-		taskId, err := strconv.Atoi(taskIdStr)
-		if err != nil {
-			return events.APIGatewayProxyResponse{
-				StatusCode: 400,
-				Body:       "Invalid parameter: task_id",
-			}, nil
+		// Images may be uploaded before their task exists, in which case
+		// task_id stays NULL until update_image attaches it
+		var taskId *int
+		if taskIdStr, exists := request.QueryStringParameters["task_id"]; exists {
+			parsedTaskId, err := strconv.Atoi(taskIdStr)
+			if err != nil {
+				return events.APIGatewayProxyResponse{
+					StatusCode: 400,
+					Body:       "Invalid parameter: task_id",
+				}, nil
+			}
+			taskId = &parsedTaskId
+		}
+
+		// Submissions to recurring tasks belong to one occurrence
+		occurrence_start, res := getOccurrenceParameter(request)
+		if res != nil {
+			return *res, nil
+		}
+		if taskId != nil {
+			var err error
+			occurrence_start, err = findOccurrence(*taskId, occurrence_start)
+			if err != nil {
+				return events.APIGatewayProxyResponse{
+					StatusCode: 400,
+					Body:       fmt.Sprintf("Invalid occurrence: %v", err),
+				}, nil
+			}
 		}
 
 		var img_id int
 
-		err = dbConn.QueryRow(context.Background(), `
-			INSERT INTO img (task_id, uploaded, caption)
-			VALUES ($1, $2, $3)
+		err := dbConn.QueryRow(context.Background(), `
+			INSERT INTO img (task_id, uploaded, caption, occurrence_start, uploader)
+			VALUES ($1, $2, $3, $4, $5)
 			RETURNING id
 		`,
 			taskId,
 			time.Now(),
 			caption,
+			occurrence_start,
+			getRequestUser(request),
 		).Scan(&img_id)
 
 		if err != nil {
@@ -221,14 +448,14 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 			image_body = []byte(request.Body)
 		}
 
-		spew.Dump(request)
-
 		// Upload image to S3
+		upload_start := time.Now()
 		_, err = s3Client.PutObject(&s3.PutObjectInput{
-			Bucket: aws.String("spontaniapp-imgs"),
+			Bucket: aws.String(config.ImageBucket),
 			Key:    aws.String(fmt.Sprintf("%d", img_id)),
 			Body:   bytes.NewReader(image_body),
 		})
+		observeExternalCall("s3", "put_object", upload_start, err)
 
 		if err != nil {
 			return events.APIGatewayProxyResponse{
@@ -273,15 +500,28 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 			}, nil
 		}
 
-		var err error
+		// The submission moves to an occurrence of its new task, like on
+		// upload
+		occurrence_start, res := getOccurrenceParameter(request)
+		if res != nil {
+			return *res, nil
+		}
+		occurrence_start, err := findOccurrence(task_id, occurrence_start)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf("Invalid occurrence: %v", err),
+			}, nil
+		}
+
 		if len(caption) > 0 {
 			_, err = dbConn.Exec(context.Background(), `
-			UPDATE img SET task_id = $1, caption = $3 WHERE id = $2
-		`, task_id, img_id, caption)
+			UPDATE img SET task_id = $1, caption = $3, occurrence_start = $4 WHERE id = $2
+		`, task_id, img_id, caption, occurrence_start)
 		} else {
 			_, err = dbConn.Exec(context.Background(), `
-			UPDATE img SET task_id = $1 WHERE id = $2
-		`, task_id, img_id)
+			UPDATE img SET task_id = $1, occurrence_start = $3 WHERE id = $2
+		`, task_id, img_id, occurrence_start)
 		}
 		if err != nil {
 			return events.APIGatewayProxyResponse{
@@ -318,15 +558,31 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 
 		var likes int
 
+		// Known users like a task at most once, anonymous likes still count.
+		// Hidden tasks can't be liked
 		err := dbConn.QueryRow(context.Background(), `
+				WITH new_like AS (
+					INSERT INTO task_like (task_id, user_id)
+					SELECT $1::integer, $2::varchar
+						WHERE $2 <> '' AND EXISTS (SELECT 1 FROM task WHERE id = $1 AND NOT hidden)
+					ON CONFLICT DO NOTHING
+					RETURNING task_id
+				)
 				UPDATE task
-				SET likes = likes + 1
-				WHERE id = $1
+				SET likes = likes + CASE WHEN $2 = '' THEN 1 ELSE (SELECT count(*) FROM new_like) END
+				WHERE id = $1 AND NOT hidden
 				RETURNING likes
 			`,
 			task_id,
+			getRequestUser(request),
 		).Scan(&likes)
 
+		if errors.Is(err, pgx.ErrNoRows) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 404,
+				Body:       "Not found",
+			}, nil
+		}
 		if err != nil {
 			return events.APIGatewayProxyResponse{
 				StatusCode: 500,
@@ -339,6 +595,24 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 			Body:       fmt.Sprintf("{\"likes\":%d}", likes),
 		}, nil
 
+	case "create_comment":
+		return createComment(request), nil
+	case "delete_comment":
+		return deleteComment(request), nil
+	case "react":
+		return reactToImage(request, false), nil
+	case "unreact":
+		return reactToImage(request, true), nil
+	case "report":
+		return reportContent(request), nil
+	case "get_reports":
+		return getReports(request), nil
+	case "moderate":
+		return moderate(request), nil
+	case "get_moderation_log":
+		return getModerationLog(request), nil
+	case "refresh_occurrences":
+		return refreshOccurrencesJob(request), nil
 	case "get_presigned_url":
 		img_id_str, exists := request.QueryStringParameters["id"]
 		if !exists {
@@ -357,11 +631,11 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 		}
 
 		req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
-			Bucket: aws.String("spontaniapp-imgs"),
+			Bucket: aws.String(config.ImageBucket),
 			Key:    aws.String(fmt.Sprintf("%d", img_id)),
 		})
 
-		url, err := req.Presign(15 * time.Minute)
+		url, err := req.Presign(config.UploadURLTTL)
 		if err != nil {
 			return events.APIGatewayProxyResponse{
 				StatusCode: 500,
@@ -383,27 +657,32 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 
 }
 
-func corsHandlerWrapper(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	response, err := handler(request)
-	if err != nil {
-		return events.APIGatewayProxyResponse{
-			StatusCode: 500,
-			Body:       fmt.Sprintf("Internal server error: %v", err),
-			Headers: map[string]string{
-				"Content-Type": "text/plain",
-			},
-		}, nil
+var limitedHandler = rateLimitMiddleware(handler)
+
+func main() {
+	setup()
+
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImportCommand(os.Args[2:]))
 	}
 
-	response.Headers = map[string]string{}
-	response.Headers["Access-Control-Allow-Origin"] = "*"
-	response.Headers["Access-Control-Allow-Headers"] = "*"
-	response.Headers["Access-Control-Allow-Methods"] = "*"
-	response.Headers["Access-Control-Allow-Credentials"] = "true"
+	wrapped_handler := metricsMiddleware(loggingMiddleware(corsMiddleware(limitedHandler)))
 
-	return response, nil
-}
+	// Local mode serves plain HTTP, keeps the rate limits in memory and
+	// stands in for the schedule that moves occurrences forward
+	if config.LocalMode {
+		go func() {
+			for range time.Tick(occurrenceRefreshInterval) {
+				if _, err := refreshOccurrences(); err != nil {
+					slog.Error("refreshing occurrences failed", "error", err)
+				}
+			}
+		}()
+		if err := runLocalServer(wrapped_handler); err != nil {
+			panic(fmt.Sprintf("Local server failed: %v", err))
+		}
+		return
+	}
 
-func main() {
-	lambda.Start(corsHandlerWrapper)
+	lambda.Start(wrapped_handler)
 }
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/jackc/pgx/v5"
+)
+
+// CloudWatch namespace of the embedded metrics
+const metricsNamespace = "SpontaniApp"
+
+// Upper bounds in milliseconds of the Prometheus histogram buckets
+var latencyBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type metricSeries struct {
+	name   string
+	labels []string
+}
+
+// One observation waiting to be written as Embedded Metric Format
+type emfValue struct {
+	series metricSeries
+	unit   string
+	value  float64
+}
+
+// Metrics of the running process. On Lambda the observations of a request
+// are written to the log as Embedded Metric Format when it ends, CloudWatch
+// aggregates them. The local server instead keeps totals for /metrics
+type metricsRecorder struct {
+	mutex      sync.Mutex
+	histograms map[string]*histogram
+	counters   map[string]float64
+	series     map[string]metricSeries
+	pending    []emfValue
+}
+
+var metrics = &metricsRecorder{
+	histograms: map[string]*histogram{},
+	counters:   map[string]float64{},
+	series:     map[string]metricSeries{},
+}
+
+// Label pairs as alternating names and values
+func (m *metricsRecorder) key(name string, labels []string) string {
+	key := name + "{" + strings.Join(labels, ",") + "}"
+	if _, exists := m.series[key]; !exists {
+		m.series[key] = metricSeries{name: name, labels: labels}
+	}
+	return key
+}
+
+func (m *metricsRecorder) observe(name string, duration time.Duration, labels ...string) {
+	value := float64(duration.Microseconds()) / 1000
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !config.LocalMode {
+		m.pending = append(m.pending, emfValue{metricSeries{name, labels}, "Milliseconds", value})
+		return
+	}
+
+	key := m.key(name, labels)
+	h, exists := m.histograms[key]
+	if !exists {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.histograms[key] = h
+	}
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (m *metricsRecorder) count(name string, labels ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !config.LocalMode {
+		m.pending = append(m.pending, emfValue{metricSeries{name, labels}, "Count", 1})
+		return
+	}
+
+	m.counters[m.key(name, labels)]++
+}
+
+// Write the pending observations as one EMF line per metric and label set
+func (m *metricsRecorder) flushEMF(w io.Writer, request_id string) {
+	m.mutex.Lock()
+	pending := m.pending
+	m.pending = nil
+	m.mutex.Unlock()
+
+	type emfGroup struct {
+		series metricSeries
+		unit   string
+		values []float64
+	}
+	groups := map[string]*emfGroup{}
+	order := []string{}
+	for _, value := range pending {
+		key := value.series.name + "{" + strings.Join(value.series.labels, ",") + "}"
+		group, exists := groups[key]
+		if !exists {
+			group = &emfGroup{series: value.series, unit: value.unit}
+			groups[key] = group
+			order = append(order, key)
+		}
+		group.values = append(group.values, value.value)
+	}
+
+	timestamp := time.Now().UnixMilli()
+	for _, key := range order {
+		group := groups[key]
+		dimensions := []string{}
+		document := map[string]interface{}{
+			"request_id":      request_id,
+			group.series.name: group.values,
+		}
+		for i := 0; i+1 < len(group.series.labels); i += 2 {
+			dimensions = append(dimensions, group.series.labels[i])
+			document[group.series.labels[i]] = group.series.labels[i+1]
+		}
+		document["_aws"] = map[string]interface{}{
+			"Timestamp": timestamp,
+			"CloudWatchMetrics": []interface{}{map[string]interface{}{
+				"Namespace":  metricsNamespace,
+				"Dimensions": [][]string{dimensions},
+				"Metrics": []interface{}{map[string]string{
+					"Name": group.series.name,
+					"Unit": group.unit,
+				}},
+			}},
+		}
+
+		line, err := json.Marshal(document)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintln(w, string(line))
+	}
+}
+
+func formatPrometheusLabels(labels []string, extra ...string) string {
+	labels = append(slices.Clip(labels), extra...)
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Totals in the Prometheus text format
+func (m *metricsRecorder) writePrometheus(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	typed := map[string]bool{}
+	for _, key := range keys {
+		series := m.series[key]
+		if h, exists := m.histograms[key]; exists {
+			if !typed[series.name] {
+				fmt.Fprintf(w, "# TYPE %s histogram\n", series.name)
+				typed[series.name] = true
+			}
+			for i, bound := range latencyBuckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", series.name,
+					formatPrometheusLabels(series.labels, "le", fmt.Sprint(bound)), h.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", series.name, formatPrometheusLabels(series.labels, "le", "+Inf"), h.count)
+			fmt.Fprintf(w, "%s_sum%s %g\n", series.name, formatPrometheusLabels(series.labels), h.sum)
+			fmt.Fprintf(w, "%s_count%s %d\n", series.name, formatPrometheusLabels(series.labels), h.count)
+		}
+		if value, exists := m.counters[key]; exists {
+			if !typed[series.name] {
+				fmt.Fprintf(w, "# TYPE %s counter\n", series.name)
+				typed[series.name] = true
+			}
+			fmt.Fprintf(w, "%s%s %g\n", series.name, formatPrometheusLabels(series.labels), value)
+		}
+	}
+}
+
+func metricsHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.writePrometheus(w)
+}
+
+// Time of a call to Google Maps or S3, counting it as an error when it fails
+func observeExternalCall(service string, call string, start time.Time, err error) {
+	metrics.observe(service+"_call_duration_ms", time.Since(start), "call", call)
+	if err != nil {
+		metrics.count(service+"_call_errors_total", "call", call)
+	}
+}
+
+// SQL commands queries are labelled with, anything else is "other"
+var dbOperations = map[string]bool{
+	"select": true,
+	"insert": true,
+	"update": true,
+	"delete": true,
+	"with":   true,
+}
+
+type dbQueryStart struct {
+	start     time.Time
+	operation string
+}
+
+type dbQueryStartKey struct{}
+
+// Times every query of the pool by its SQL command
+type dbMetricsTracer struct{}
+
+func (t dbMetricsTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	operation := "other"
+	if fields := strings.Fields(data.SQL); len(fields) > 0 && dbOperations[strings.ToLower(fields[0])] {
+		operation = strings.ToLower(fields[0])
+	}
+	return context.WithValue(ctx, dbQueryStartKey{}, dbQueryStart{time.Now(), operation})
+}
+
+func (t dbMetricsTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	query_start, ok := ctx.Value(dbQueryStartKey{}).(dbQueryStart)
+	if !ok {
+		return
+	}
+
+	metrics.observe("db_query_duration_ms", time.Since(query_start.start), "operation", query_start.operation)
+	if data.Err != nil && !errors.Is(data.Err, pgx.ErrNoRows) {
+		metrics.count("db_query_errors_total", "operation", query_start.operation)
+	}
+}
+
+// Request type for the labels, tiles are routed by path instead. Anything
+// the handler doesn't know is "unknown" so clients can't add label values
+func requestTypeLabel(request events.APIGatewayProxyRequest) string {
+	if request.HTTPMethod == "OPTIONS" {
+		return "preflight"
+	}
+	if request_type := request.QueryStringParameters["request_type"]; request_type != "" {
+		if !knownRequestTypes[request_type] {
+			return "unknown"
+		}
+		return request_type
+	}
+	if strings.HasPrefix(request.Path, "/tiles/") {
+		return "tiles"
+	}
+	return "none"
+}
+
+// Record the latency and errors of every request. On Lambda the metrics of
+// the request are written out as EMF once it is done
+func metricsMiddleware(next func(events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) func(events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		start := time.Now()
+		response, err := next(request)
+
+		request_type := requestTypeLabel(request)
+		metrics.observe("request_duration_ms", time.Since(start), "request_type", request_type)
+		switch {
+		case err != nil || response.StatusCode >= 500:
+			metrics.count("request_errors_total", "request_type", request_type, "class", "server")
+		case response.StatusCode >= 400:
+			metrics.count("request_errors_total", "request_type", request_type, "class", "client")
+		}
+
+		if !config.LocalMode {
+			metrics.flushEMF(os.Stdout, request.RequestContext.RequestID)
+		}
+
+		return response, err
+	}
+}
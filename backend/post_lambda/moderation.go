@@ -0,0 +1,681 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jackc/pgx/v5"
+)
+
+const defaultModerationLimit = 50
+const maxModerationLimit = 200
+
+var reportReasons = map[string]bool{
+	"spam":          true,
+	"offensive":     true,
+	"inappropriate": true,
+	"dangerous":     true,
+	"other":         true,
+}
+
+const maxReportDetailsLength = 1000
+
+type ReportPost struct {
+	// task, img or comment
+	TargetType string `json:"target_type"`
+	TargetId   int    `json:"target_id"`
+	Reason     string `json:"reason"`
+	Details    string `json:"details"`
+}
+
+type ReportRet struct {
+	Id       int    `json:"id"`
+	Reporter string `json:"reporter"`
+	Reason   string `json:"reason"`
+	Details  string `json:"details"`
+	Created  int64  `json:"created"`
+}
+
+// What moderators need to judge a reported item without looking it up
+type ReportTargetRet struct {
+	Exists bool   `json:"exists"`
+	Hidden bool   `json:"hidden"`
+	Author string `json:"author"`
+	// Task title, image caption or comment body
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	TaskId      *int   `json:"task_id,omitempty"`
+	URL         string `json:"url,omitempty"`
+}
+
+type ReportQueueItemRet struct {
+	TargetType    string          `json:"target_type"`
+	TargetId      int             `json:"target_id"`
+	NumReports    int             `json:"num_reports"`
+	FirstReported int64           `json:"first_reported"`
+	LastReported  int64           `json:"last_reported"`
+	Target        ReportTargetRet `json:"target"`
+	Reports       []ReportRet     `json:"reports"`
+}
+
+type ModerationPost struct {
+	// hide, restore, delete, dismiss, ban or unban
+	Action     string `json:"action"`
+	TargetType string `json:"target_type"`
+	TargetId   int    `json:"target_id"`
+	// User to ban or unban, defaults to the author of the target
+	UserId string `json:"user_id"`
+	Reason string `json:"reason"`
+}
+
+type ModerationLogRet struct {
+	Id         int    `json:"id"`
+	Moderator  string `json:"moderator"`
+	Action     string `json:"action"`
+	TargetType string `json:"target_type"`
+	TargetId   string `json:"target_id"`
+	Reason     string `json:"reason"`
+	Created    int64  `json:"created"`
+}
+
+func forbiddenResponse() events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: 403,
+		Body:       "Forbidden",
+	}
+}
+
+func isBannedUser(user string) (bool, error) {
+	var banned bool
+	err := dbConn.QueryRow(context.Background(), `
+		SELECT EXISTS (SELECT 1 FROM banned_user WHERE user_id = $1)
+	`, user).Scan(&banned)
+
+	return banned, err
+}
+
+// Name a moderation request acts under, from its X-Admin-Token: the name
+// MODERATOR_TOKENS binds to the token, or "admin" for ADMIN_TOKEN. Empty
+// when the token matches neither
+func requestModerator(request events.APIGatewayProxyRequest) string {
+	token := ""
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, "X-Admin-Token") {
+			token = value
+			break
+		}
+	}
+	if token == "" {
+		return ""
+	}
+
+	moderator := ""
+	for name, moderator_token := range config.ModeratorTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(moderator_token)) == 1 {
+			moderator = name
+		}
+	}
+	if moderator == "" && isAdminRequest(request) {
+		moderator = "admin"
+	}
+
+	return moderator
+}
+
+func getLimitParameter(request events.APIGatewayProxyRequest) (int, *events.APIGatewayProxyResponse) {
+	limit := defaultModerationLimit
+	if limit_str, exists := request.QueryStringParameters["limit"]; exists {
+		var err error
+		limit, err = strconv.Atoi(limit_str)
+		if err != nil || limit < 1 || limit > maxModerationLimit {
+			return 0, &events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf("Invalid parameters: limit (must be between 1 and %d)", maxModerationLimit),
+			}
+		}
+	}
+
+	return limit, nil
+}
+
+// Look up a reported item. Missing items are reported with Exists false
+// since reports outlive what they point at
+func reportTarget(target_type string, target_id int) (ReportTargetRet, error) {
+	target := ReportTargetRet{Exists: true}
+	var err error
+	switch target_type {
+	case "task":
+		err = dbConn.QueryRow(context.Background(), `
+			SELECT title, description, creator, hidden FROM task WHERE id = $1
+		`, target_id).Scan(&target.Title, &target.Description, &target.Author, &target.Hidden)
+	case "img":
+		err = dbConn.QueryRow(context.Background(), `
+			SELECT caption, uploader, hidden, task_id FROM img WHERE id = $1
+		`, target_id).Scan(&target.Title, &target.Author, &target.Hidden, &target.TaskId)
+		if err == nil {
+			presigned_req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
+				Bucket: aws.String(config.ImageBucket),
+				Key:    aws.String(fmt.Sprintf("%d", target_id)),
+			})
+			target.URL, err = presigned_req.Presign(config.ImageURLTTL)
+		}
+	case "comment":
+		err = dbConn.QueryRow(context.Background(), `
+			SELECT body, author, hidden OR deleted, task_id FROM comment WHERE id = $1
+		`, target_id).Scan(&target.Title, &target.Author, &target.Hidden, &target.TaskId)
+	default:
+		return target, fmt.Errorf("unknown target type %q", target_type)
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ReportTargetRet{}, nil
+	}
+
+	return target, err
+}
+
+// Flag a task, image or comment for moderators. Each user reports an item
+// at most once
+func reportContent(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	reporter := getRequestUser(request)
+	if reporter == "" {
+		return missingUserResponse()
+	}
+
+	var post ReportPost
+	if err := json.Unmarshal([]byte(request.Body), &post); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid JSON body",
+		}
+	}
+	if !reportReasons[post.Reason] {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid reason: must be spam, offensive, inappropriate, dangerous or other",
+		}
+	}
+	if len(post.Details) > maxReportDetailsLength {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf("Invalid details: longer than %d characters", maxReportDetailsLength),
+		}
+	}
+
+	target, err := reportTarget(post.TargetType, post.TargetId)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf("Invalid target: %v", err),
+		}
+	}
+	if !target.Exists {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       "Not found",
+		}
+	}
+
+	_, err = dbConn.Exec(context.Background(), `
+		INSERT INTO report (target_type, target_id, reporter, reason, details)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT DO NOTHING
+	`, post.TargetType, post.TargetId, reporter, post.Reason, post.Details)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       "{}",
+	}
+}
+
+// Moderation queue: reported items with their reports, most reported first
+func getReports(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if requestModerator(request) == "" {
+		return forbiddenResponse()
+	}
+
+	status := request.QueryStringParameters["status"]
+	switch status {
+	case "":
+		status = "open"
+	case "open", "resolved", "dismissed":
+	default:
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid parameters: status (must be open, resolved or dismissed)",
+		}
+	}
+
+	limit, res := getLimitParameter(request)
+	if res != nil {
+		return *res
+	}
+
+	rows, err := dbConn.Query(context.Background(), `
+		SELECT target_type, target_id, count(*), min(created), max(created),
+			json_agg(json_build_object(
+				'id', id,
+				'reporter', reporter,
+				'reason', reason,
+				'details', details,
+				'created', extract(epoch FROM created)::bigint
+			) ORDER BY created)
+			FROM report
+			WHERE status = $1
+			GROUP BY target_type, target_id
+			ORDER BY count(*) DESC, min(created)
+			LIMIT $2
+	`, status, limit)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+
+	queue := []ReportQueueItemRet{}
+	for rows.Next() {
+		var item ReportQueueItemRet
+		var first_reported, last_reported time.Time
+		err := rows.Scan(&item.TargetType, &item.TargetId, &item.NumReports,
+			&first_reported, &last_reported, &item.Reports)
+		if err != nil {
+			rows.Close()
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       fmt.Sprintf("Database error: %v", err),
+			}
+		}
+		item.FirstReported = first_reported.Unix()
+		item.LastReported = last_reported.Unix()
+		queue = append(queue, item)
+	}
+	if err := rows.Err(); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+	rows.Close()
+
+	for i := range queue {
+		queue[i].Target, err = reportTarget(queue[i].TargetType, queue[i].TargetId)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       fmt.Sprintf("Database error: %v", err),
+			}
+		}
+	}
+
+	queue_json, err := json.Marshal(queue)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("JSON marshalling error: %v", err),
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       string(queue_json),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
+
+// Hide or restore an item, keeping the comment count of its task in step
+// Change of a comment count when items are hidden or shown again
+func hiddenCountChange(hidden bool) int {
+	if hidden {
+		return -1
+	}
+	return 1
+}
+
+func setHidden(tx pgx.Tx, target_type string, target_id int, hidden bool) error {
+	var err error
+	switch target_type {
+	case "task":
+		_, err = tx.Exec(context.Background(), `
+			UPDATE task SET hidden = $2 WHERE id = $1
+		`, target_id, hidden)
+	case "img":
+		var task_id *int
+		var was_hidden bool
+		err = tx.QueryRow(context.Background(), `
+			SELECT task_id, hidden FROM img WHERE id = $1 FOR UPDATE
+		`, target_id).Scan(&task_id, &was_hidden)
+		if err == nil {
+			_, err = tx.Exec(context.Background(), `
+				UPDATE img SET hidden = $2 WHERE id = $1
+			`, target_id, hidden)
+		}
+		// Comments on a hidden image don't count toward its task
+		if err == nil && task_id != nil && was_hidden != hidden {
+			_, err = tx.Exec(context.Background(), `
+				UPDATE task SET num_comments = num_comments + $3 * (
+					SELECT count(*) FROM comment
+						WHERE img_id = $2 AND NOT deleted AND NOT hidden
+				)
+				WHERE id = $1
+			`, *task_id, target_id, hiddenCountChange(hidden))
+		}
+		if err == nil && task_id != nil {
+			err = updateTopImage(tx, *task_id)
+		}
+	case "comment":
+		_, err = tx.Exec(context.Background(), `
+			WITH changed AS (
+				UPDATE comment SET hidden = $2
+					WHERE id = $1 AND hidden <> $2
+					RETURNING task_id, img_id, deleted
+			)
+			UPDATE task SET num_comments = num_comments + $3
+				FROM changed
+				WHERE task.id = changed.task_id AND NOT changed.deleted
+					AND NOT EXISTS (SELECT 1 FROM img WHERE img.id = changed.img_id AND img.hidden)
+		`, target_id, hidden, hiddenCountChange(hidden))
+	}
+
+	return err
+}
+
+// Remove an item for good. Comments keep their row like when their author
+// deletes them. Returns the images to remove from S3
+func deleteTarget(tx pgx.Tx, target_type string, target_id int) ([]int, error) {
+	var err error
+	switch target_type {
+	case "task":
+		// Images would only lose their task, take them along
+		var rows pgx.Rows
+		rows, err = tx.Query(context.Background(), `
+			DELETE FROM img WHERE task_id = $1 RETURNING id
+		`, target_id)
+		if err != nil {
+			return nil, err
+		}
+		img_ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.Exec(context.Background(), `
+			DELETE FROM task WHERE id = $1
+		`, target_id)
+		if err != nil {
+			return nil, err
+		}
+		return img_ids, nil
+	case "img":
+		// Comments on the image go with it, a hidden image's no longer count
+		_, err = tx.Exec(context.Background(), `
+			UPDATE task SET num_comments = num_comments - (
+				SELECT count(*) FROM comment
+					WHERE img_id = $1 AND NOT deleted AND NOT hidden
+			)
+			WHERE id = (SELECT task_id FROM img WHERE id = $1 AND NOT hidden)
+		`, target_id)
+		if err == nil {
+			var task_id *int
+			err = tx.QueryRow(context.Background(), `
+				DELETE FROM img WHERE id = $1 RETURNING task_id
+			`, target_id).Scan(&task_id)
+			if err == nil && task_id != nil {
+				err = updateTopImage(tx, *task_id)
+			}
+			if err == nil {
+				return []int{target_id}, nil
+			}
+		}
+	case "comment":
+		_, err = tx.Exec(context.Background(), `
+			WITH changed AS (
+				UPDATE comment SET deleted = true, body = ''
+					WHERE id = $1 AND NOT deleted
+					RETURNING task_id, img_id, hidden
+			)
+			UPDATE task SET num_comments = num_comments - 1
+				FROM changed
+				WHERE task.id = changed.task_id AND NOT changed.hidden
+					AND NOT EXISTS (SELECT 1 FROM img WHERE img.id = changed.img_id AND img.hidden)
+		`, target_id)
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = nil
+	}
+
+	return nil, err
+}
+
+// Apply a moderator action and record it in the moderation log. Acting on a
+// reported item closes its open reports
+func moderate(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	moderator := requestModerator(request)
+	if moderator == "" {
+		return forbiddenResponse()
+	}
+
+	var post ModerationPost
+	if err := json.Unmarshal([]byte(request.Body), &post); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid JSON body",
+		}
+	}
+
+	switch post.Action {
+	case "hide", "restore", "delete", "dismiss", "ban", "unban":
+	default:
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid action: must be hide, restore, delete, dismiss, ban or unban",
+		}
+	}
+
+	is_user_action := post.Action == "ban" || post.Action == "unban"
+	if !is_user_action || post.UserId == "" {
+		target, err := reportTarget(post.TargetType, post.TargetId)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf("Invalid target: %v", err),
+			}
+		}
+		if !target.Exists {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 404,
+				Body:       "Not found",
+			}
+		}
+		if is_user_action {
+			post.UserId = target.Author
+		}
+	}
+	if is_user_action && post.UserId == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid target: author unknown, give a user_id",
+		}
+	}
+
+	tx, err := dbConn.Begin(context.Background())
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+	defer tx.Rollback(context.Background())
+
+	var deleted_img_ids []int
+	report_status := "resolved"
+	switch post.Action {
+	case "hide":
+		err = setHidden(tx, post.TargetType, post.TargetId, true)
+	case "restore":
+		err = setHidden(tx, post.TargetType, post.TargetId, false)
+		report_status = "dismissed"
+	case "delete":
+		deleted_img_ids, err = deleteTarget(tx, post.TargetType, post.TargetId)
+	case "dismiss":
+		report_status = "dismissed"
+	case "ban":
+		_, err = tx.Exec(context.Background(), `
+			INSERT INTO banned_user (user_id, banned_by, reason) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id) DO UPDATE SET banned_by = $2, reason = $3
+		`, post.UserId, moderator, post.Reason)
+	case "unban":
+		_, err = tx.Exec(context.Background(), `
+			DELETE FROM banned_user WHERE user_id = $1
+		`, post.UserId)
+	}
+
+	if err == nil && post.Action != "unban" && post.TargetType != "" {
+		_, err = tx.Exec(context.Background(), `
+			UPDATE report SET status = $3
+				WHERE target_type = $1 AND target_id = $2 AND status = 'open'
+		`, post.TargetType, post.TargetId, report_status)
+	}
+
+	log_type, log_id := post.TargetType, strconv.Itoa(post.TargetId)
+	if is_user_action {
+		log_type, log_id = "user", post.UserId
+	}
+	if err == nil {
+		_, err = tx.Exec(context.Background(), `
+			INSERT INTO moderation_log (moderator, action, target_type, target_id, reason)
+			VALUES ($1, $2, $3, $4, $5)
+		`, moderator, post.Action, log_type, log_id, post.Reason)
+	}
+	if err == nil {
+		err = tx.Commit(context.Background())
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+
+	// The rows are gone already, try every object before reporting failures
+	failed_img_ids := []string{}
+	var s3_err error
+	for _, img_id := range deleted_img_ids {
+		delete_start := time.Now()
+		_, err = s3Client.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(config.ImageBucket),
+			Key:    aws.String(fmt.Sprintf("%d", img_id)),
+		})
+		observeExternalCall("s3", "delete_object", delete_start, err)
+		if err != nil {
+			failed_img_ids = append(failed_img_ids, strconv.Itoa(img_id))
+			s3_err = err
+		}
+	}
+	if len(failed_img_ids) > 0 {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body: fmt.Sprintf("Deleted but images %s not removed from S3: %v",
+				strings.Join(failed_img_ids, ", "), s3_err),
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       "{}",
+	}
+}
+
+// Audit log of moderator actions, newest first. Pass the smallest id seen
+// as before to page back
+func getModerationLog(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if requestModerator(request) == "" {
+		return forbiddenResponse()
+	}
+
+	limit, res := getLimitParameter(request)
+	if res != nil {
+		return *res
+	}
+
+	var before *int
+	if before_str, exists := request.QueryStringParameters["before"]; exists {
+		before_id, err := strconv.Atoi(before_str)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       "Invalid parameters: before",
+			}
+		}
+		before = &before_id
+	}
+
+	rows, err := dbConn.Query(context.Background(), `
+		SELECT id, moderator, action, target_type, target_id, reason, created
+			FROM moderation_log
+			WHERE $1::integer IS NULL OR id < $1
+			ORDER BY id DESC
+			LIMIT $2
+	`, before, limit)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+	defer rows.Close()
+
+	entries := []ModerationLogRet{}
+	for rows.Next() {
+		var entry ModerationLogRet
+		var created time.Time
+		err := rows.Scan(&entry.Id, &entry.Moderator, &entry.Action, &entry.TargetType,
+			&entry.TargetId, &entry.Reason, &created)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       fmt.Sprintf("Database error: %v", err),
+			}
+		}
+		entry.Created = created.Unix()
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+
+	entries_json, err := json.Marshal(entries)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("JSON marshalling error: %v", err),
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       string(entries_json),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+}
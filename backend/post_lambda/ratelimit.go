@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+type rateBudget struct {
+	Limit  int
+	Window time.Duration
+}
+
+// Requests allowed per user or device within each window. Request types
+// missing here are not limited, get_presigned_url among them since it only
+// signs a read link and listings ask for one per task on every map move
+var rateBudgets = map[string]rateBudget{
+	"create_task":    {Limit: 10, Window: time.Hour},
+	"edit_task":      {Limit: 30, Window: time.Hour},
+	"upload_image":   {Limit: 30, Window: time.Hour},
+	"update_image":   {Limit: 60, Window: time.Hour},
+	"like":           {Limit: 60, Window: time.Minute},
+	"react":          {Limit: 60, Window: time.Minute},
+	"unreact":        {Limit: 60, Window: time.Minute},
+	"create_comment": {Limit: 20, Window: 10 * time.Minute},
+	"delete_comment": {Limit: 20, Window: 10 * time.Minute},
+	"report":         {Limit: 20, Window: time.Hour},
+}
+
+// Many users can share an address behind NAT, so IPs get a larger budget
+const ipBudgetMultiplier = 5
+
+// Counts requests per key in fixed windows
+type rateLimitStore interface {
+	// Count one request for key in the window starting at window_start and
+	// return the number of requests in that window so far
+	Hit(ctx context.Context, key string, window_start time.Time, window time.Duration) (int, error)
+}
+
+// Shared by every Lambda instance
+type postgresRateLimitStore struct{}
+
+func (s postgresRateLimitStore) Hit(ctx context.Context, key string, window_start time.Time, window time.Duration) (int, error) {
+	// Expired windows are cleared now and then rather than on every request
+	if rand.Intn(100) == 0 {
+		_, err := dbConn.Exec(ctx, `
+			DELETE FROM rate_limit WHERE window_start < $1
+		`, time.Now().Add(-24*time.Hour))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var count int
+	err := dbConn.QueryRow(ctx, `
+		INSERT INTO rate_limit (key, window_start, count) VALUES ($1, $2, 1)
+		ON CONFLICT (key, window_start) DO UPDATE SET count = rate_limit.count + 1
+		RETURNING count
+	`, key, window_start).Scan(&count)
+
+	return count, err
+}
+
+// Per process counters for running locally without the database table
+type memoryRateLimitStore struct {
+	mutex   sync.Mutex
+	windows map[string]memoryRateWindow
+}
+
+type memoryRateWindow struct {
+	start time.Time
+	end   time.Time
+	count int
+}
+
+func (s *memoryRateLimitStore) Hit(ctx context.Context, key string, window_start time.Time, window time.Duration) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for window_key, entry := range s.windows {
+		if now.After(entry.end) {
+			delete(s.windows, window_key)
+		}
+	}
+
+	entry := s.windows[key]
+	if !entry.start.Equal(window_start) {
+		entry = memoryRateWindow{start: window_start, end: window_start.Add(window)}
+	}
+	entry.count++
+	s.windows[key] = entry
+
+	return entry.count, nil
+}
+
+var rateLimiter rateLimitStore = postgresRateLimitStore{}
+
+func initRateLimiter() {
+	if config.LocalMode {
+		rateLimiter = &memoryRateLimitStore{windows: map[string]memoryRateWindow{}}
+	}
+}
+
+// Keys a request is counted under: the user or device when known and always
+// the source IP
+func rateLimitKeys(request events.APIGatewayProxyRequest) map[string]int {
+	keys := map[string]int{}
+	if user := getRequestUser(request); user != "" {
+		keys["user:"+user] = 1
+	}
+	if source_ip := request.RequestContext.Identity.SourceIP; source_ip != "" {
+		keys["ip:"+source_ip] = ipBudgetMultiplier
+	}
+
+	return keys
+}
+
+// Reject requests over their budget with 429 and a Retry-After header.
+// Store failures let requests through rather than take the API down
+func rateLimitMiddleware(next func(events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) func(events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		request_type := request.QueryStringParameters["request_type"]
+		budget, limited := rateBudgets[request_type]
+		if !limited || !config.Features.RateLimit || isAdminRequest(request) {
+			return next(request)
+		}
+
+		now := time.Now()
+		window_start := now.Truncate(budget.Window)
+		for key, multiplier := range rateLimitKeys(request) {
+			count, err := rateLimiter.Hit(context.Background(),
+				fmt.Sprintf("%s:%s", request_type, key), window_start, budget.Window)
+			if err != nil {
+				slog.Error("rate limiter failed", "error", err)
+				break
+			}
+
+			if count > budget.Limit*multiplier {
+				retry_after := int(window_start.Add(budget.Window).Sub(now).Seconds()) + 1
+				return events.APIGatewayProxyResponse{
+					StatusCode: 429,
+					Body:       fmt.Sprintf("Too many %s requests, retry in %d seconds", request_type, retry_after),
+					Headers: map[string]string{
+						"Content-Type": "text/plain",
+						"Retry-After":  strconv.Itoa(retry_after),
+					},
+				}, nil
+			}
+		}
+
+		return next(request)
+	}
+}
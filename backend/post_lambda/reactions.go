@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Reactions a submission can get, by name. Clients pick the emoji for each
+var reactionTypes = map[string]bool{
+	"heart": true,
+	"fire":  true,
+	"laugh": true,
+	"wow":   true,
+	"clap":  true,
+}
+
+// Point a task at its submission with the most reactions. The earliest of
+// the most reacted wins ties, hidden submissions never do
+func updateTopImage(tx pgx.Tx, task_id int) error {
+	_, err := tx.Exec(context.Background(), `
+		UPDATE task SET top_img_id = (
+			SELECT id FROM img WHERE task_id = $1 AND num_reactions > 0 AND NOT hidden
+				ORDER BY num_reactions DESC, uploaded, id
+				LIMIT 1
+		) WHERE id = $1
+	`, task_id)
+
+	return err
+}
+
+// Add or, with remove, take back a reaction of the caller on an image. Each
+// user reacts at most once per type, repeating a request changes nothing
+func reactToImage(request events.APIGatewayProxyRequest, remove bool) events.APIGatewayProxyResponse {
+	user := getRequestUser(request)
+	if user == "" {
+		return missingUserResponse()
+	}
+
+	img_id_str, img_id_exists := request.QueryStringParameters["img_id"]
+	reaction, reaction_exists := request.QueryStringParameters["reaction"]
+	if !img_id_exists || !reaction_exists {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Missing required parameters: img_id, reaction",
+		}
+	}
+
+	img_id, err := strconv.Atoi(img_id_str)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid required parameter: img_id",
+		}
+	}
+	if !reactionTypes[reaction] {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid required parameter: reaction (must be heart, fire, laugh, wow or clap)",
+		}
+	}
+
+	tx, err := dbConn.Begin(context.Background())
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+	defer tx.Rollback(context.Background())
+
+	var task_id *int
+	err = tx.QueryRow(context.Background(), `
+		SELECT task_id FROM img WHERE id = $1 AND NOT hidden
+			AND NOT EXISTS (SELECT 1 FROM task WHERE task.id = img.task_id AND task.hidden)
+			FOR UPDATE
+	`, img_id).Scan(&task_id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       "Not found",
+		}
+	}
+
+	var changed int64
+	if err == nil {
+		var tag pgconn.CommandTag
+		if remove {
+			tag, err = tx.Exec(context.Background(), `
+				DELETE FROM img_reaction WHERE img_id = $1 AND user_id = $2 AND reaction = $3
+			`, img_id, user, reaction)
+		} else {
+			tag, err = tx.Exec(context.Background(), `
+				INSERT INTO img_reaction (img_id, user_id, reaction) VALUES ($1, $2, $3)
+				ON CONFLICT DO NOTHING
+			`, img_id, user, reaction)
+		}
+		changed = tag.RowsAffected()
+		if remove {
+			changed = -changed
+		}
+	}
+
+	if err == nil && changed != 0 {
+		_, err = tx.Exec(context.Background(), `
+			UPDATE img SET num_reactions = num_reactions + $2 WHERE id = $1
+		`, img_id, changed)
+
+		if err == nil && task_id != nil {
+			err = updateTopImage(tx, *task_id)
+		}
+	}
+
+	reactions := map[string]int{}
+	if err == nil {
+		err = tx.QueryRow(context.Background(), `
+			SELECT coalesce(json_object_agg(reaction, count), '{}') FROM (
+				SELECT reaction, count(*) FROM img_reaction WHERE img_id = $1 GROUP BY reaction
+			) counts
+		`, img_id).Scan(&reactions)
+	}
+	if err == nil {
+		err = tx.Commit(context.Background())
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+
+	reactions_json, err := json.Marshal(map[string]interface{}{
+		"reactions": reactions,
+	})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("JSON marshalling error: %v", err),
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       string(reactions_json),
+	}
+}
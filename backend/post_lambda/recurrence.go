@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/teambition/rrule-go"
+)
+
+// Series are bounded so that walking one stays cheap
+const maxSeriesLength = 2 * 366 * 24 * time.Hour
+const maxSeriesOccurrences = 1000
+
+// Build the recurrence rule of a task, anchored at its first occurrence and
+// ending with the series. Occurrences are generated in the zone of start so
+// wall clock times stay put across daylight saving changes
+func taskRecurrence(rrule_str string, start time.Time, stop time.Time) (*rrule.RRule, error) {
+	option, err := rrule.StrToROption(rrule_str)
+	if err != nil {
+		return nil, err
+	}
+
+	option.Dtstart = start
+	if option.Until.IsZero() || option.Until.After(stop) {
+		option.Until = stop
+	}
+
+	return rrule.NewRRule(*option)
+}
+
+// Check the rule of a new task: at most daily, with at least one and at
+// most maxSeriesOccurrences occurrences in a series of bounded length
+func validateRecurrence(rrule_str string, start time.Time, stop time.Time) error {
+	option, err := rrule.StrToROption(rrule_str)
+	if err != nil {
+		return err
+	}
+	if option.Freq > rrule.DAILY {
+		return fmt.Errorf("FREQ must be YEARLY, MONTHLY, WEEKLY or DAILY")
+	}
+	if option.Count > maxSeriesOccurrences {
+		return fmt.Errorf("COUNT must be at most %d", maxSeriesOccurrences)
+	}
+	if stop.Sub(start) > maxSeriesLength {
+		return fmt.Errorf("series must not last longer than %d days", int(maxSeriesLength.Hours()/24))
+	}
+
+	rule, err := taskRecurrence(rrule_str, start, stop)
+	if err != nil {
+		return err
+	}
+
+	// BYHOUR and the like still multiply the occurrences of a day
+	next := rule.Iterator()
+	count := 0
+	for _, ok := next(); ok; _, ok = next() {
+		count++
+		if count > maxSeriesOccurrences {
+			return fmt.Errorf("series must not have more than %d occurrences", maxSeriesOccurrences)
+		}
+	}
+	if count == 0 {
+		return fmt.Errorf("no occurrences between start and stop")
+	}
+
+	return nil
+}
+
+// Occurrence of the rule running at now or the next one, or the last one
+// once the series is over. Also tells whether no occurrence follows it
+func currentOccurrence(rule *rrule.RRule, duration time.Duration, now time.Time) (time.Time, bool) {
+	next := rule.Iterator()
+	var last time.Time
+	for i := 0; i < maxSeriesOccurrences; i++ {
+		occurrence, ok := next()
+		if !ok {
+			break
+		}
+		if occurrence.Add(duration).After(now) {
+			_, more := next()
+			return occurrence, !more
+		}
+		last = occurrence
+	}
+
+	return last, true
+}
+
+// Current or next occurrence of a task as stored in its occurrence columns.
+// A task that doesn't recur has a single occurrence from start to stop
+func taskOccurrence(rrule_str string, duration int64, start time.Time, stop time.Time, time_zone string) (time.Time, time.Time, bool, error) {
+	if rrule_str == "" {
+		return start, stop, true, nil
+	}
+
+	location, err := time.LoadLocation(time_zone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	rule, err := taskRecurrence(rrule_str, start.In(location), stop.In(location))
+	if err != nil {
+		return start, stop, true, err
+	}
+
+	occurrence_duration := time.Duration(duration) * time.Second
+	occurrence, final := currentOccurrence(rule, occurrence_duration, time.Now())
+	if occurrence.IsZero() {
+		return start, start.Add(occurrence_duration), true, nil
+	}
+
+	return occurrence, occurrence.Add(occurrence_duration), final, nil
+}
+
+// Recurring tasks moved forward per batch of refreshOccurrences
+const occurrenceRefreshBatch = 500
+
+// How often the schedule runs refreshOccurrences, set in terraform/main.tf
+const occurrenceRefreshInterval = time.Minute
+
+// Move the occurrence columns of recurring tasks whose occurrence has ended
+// on to their current one, which listings filter and sort on. Runs on a
+// schedule, returns the number of tasks moved
+func refreshOccurrences() (int, error) {
+	refreshed := 0
+	for {
+		rows, err := dbConn.Query(context.Background(), `
+			SELECT id, rrule, duration, start, stop, time_zone FROM task
+				WHERE NOT occurrence_final AND occurrence_stop <= now()
+				LIMIT $1
+		`, occurrenceRefreshBatch)
+		if err != nil {
+			return refreshed, err
+		}
+
+		ids := []int{}
+		starts := []time.Time{}
+		stops := []time.Time{}
+		finals := []bool{}
+		for rows.Next() {
+			var id int
+			var rrule_str, time_zone string
+			var duration int64
+			var start, stop time.Time
+			if err := rows.Scan(&id, &rrule_str, &duration, &start, &stop, &time_zone); err != nil {
+				rows.Close()
+				return refreshed, err
+			}
+
+			// Rules are validated on creation, one that no longer parses
+			// stays at the occurrence returned with the error for good
+			occurrence_start, occurrence_stop, final, err := taskOccurrence(rrule_str, duration, start, stop, time_zone)
+			if err != nil {
+				final = true
+			}
+
+			ids = append(ids, id)
+			starts = append(starts, occurrence_start)
+			stops = append(stops, occurrence_stop)
+			finals = append(finals, final)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return refreshed, err
+		}
+		if len(ids) == 0 {
+			return refreshed, nil
+		}
+
+		_, err = dbConn.Exec(context.Background(), `
+			UPDATE task SET occurrence_start = occurrence.start, occurrence_stop = occurrence.stop,
+				occurrence_final = occurrence.final
+				FROM unnest($1::int[], $2::timestamptz[], $3::timestamptz[], $4::boolean[])
+					AS occurrence(id, start, stop, final)
+				WHERE task.id = occurrence.id
+		`, ids, starts, stops, finals)
+		if err != nil {
+			return refreshed, err
+		}
+		refreshed += len(ids)
+
+		if len(ids) < occurrenceRefreshBatch {
+			return refreshed, nil
+		}
+	}
+}
+
+// Entry point of the scheduled refresh. Only the schedule invokes the
+// Lambda directly, requests through API Gateway carry a request id
+func refreshOccurrencesJob(request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	if request.RequestContext.RequestID != "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       "Not found",
+		}
+	}
+
+	refreshed, err := refreshOccurrences()
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       fmt.Sprintf("{\"refreshed\":%d}", refreshed),
+	}
+}
+
+// Optional occurrence_start parameter naming the occurrence of a recurring
+// task a submission belongs to
+func getOccurrenceParameter(request events.APIGatewayProxyRequest) (*time.Time, *events.APIGatewayProxyResponse) {
+	occurrence_str, exists := request.QueryStringParameters["occurrence_start"]
+	if !exists {
+		return nil, nil
+	}
+
+	occurrence_unix, err := strconv.ParseInt(occurrence_str, 10, 64)
+	if err != nil {
+		return nil, &events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid parameter: occurrence_start",
+		}
+	}
+	occurrence_start := time.Unix(occurrence_unix, 0).UTC()
+
+	return &occurrence_start, nil
+}
+
+// Resolve which occurrence of a recurring task a submission belongs to. A
+// given start must match an occurrence exactly, otherwise the occurrence
+// running right now is used. Returns nil for tasks that don't recur
+func findOccurrence(task_id int, occurrence_start *time.Time) (*time.Time, error) {
+	var rrule_str string
+	var duration int64
+	var start time.Time
+	var stop time.Time
+	var time_zone string
+	err := dbConn.QueryRow(context.Background(), `
+		SELECT rrule, duration, start, stop, time_zone FROM task WHERE id = $1
+	`, task_id).Scan(&rrule_str, &duration, &start, &stop, &time_zone)
+	if err != nil {
+		return nil, err
+	}
+
+	if rrule_str == "" {
+		return nil, nil
+	}
+
+	location, err := time.LoadLocation(time_zone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	rule, err := taskRecurrence(rrule_str, start.In(location), stop.In(location))
+	if err != nil {
+		return nil, err
+	}
+
+	if occurrence_start != nil {
+		next := rule.Iterator()
+		for i := 0; i < maxSeriesOccurrences; i++ {
+			occurrence, ok := next()
+			if !ok || occurrence.After(*occurrence_start) {
+				break
+			}
+			if occurrence.Equal(*occurrence_start) {
+				return &occurrence, nil
+			}
+		}
+		return nil, fmt.Errorf("%v is not an occurrence of task %d", occurrence_start.Unix(), task_id)
+	}
+
+	now := time.Now()
+	current, _ := currentOccurrence(rule, time.Duration(duration)*time.Second, now)
+	if current.IsZero() || current.After(now) || !now.Before(current.Add(time.Duration(duration)*time.Second)) {
+		return nil, fmt.Errorf("task %d has no occurrence running right now", task_id)
+	}
+
+	return &current, nil
+}
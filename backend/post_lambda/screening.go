@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Text a user wants to publish
+type ScreenText struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+type ScreenResult struct {
+	// Hold for review instead of publishing
+	Hold    bool     `json:"hold"`
+	Reasons []string `json:"reasons"`
+}
+
+// One step of the screening pipeline. Local rules and external classifiers
+// implement this alike
+type TextScreener interface {
+	Name() string
+	Screen(ctx context.Context, text ScreenText) (ScreenResult, error)
+}
+
+var textScreeners []TextScreener
+
+// Add a screener to the pipeline, called from init
+func registerTextScreener(screener TextScreener) {
+	textScreeners = append(textScreeners, screener)
+}
+
+// Blocked words and regular expressions, one per line in SCREEN_RULES_FILE.
+// Lines starting with "re:" are expressions, others whole words, both
+// matched case-insensitively
+type ruleScreener struct {
+	rules []*regexp.Regexp
+}
+
+var wordCharPattern = regexp.MustCompile(`\w`)
+
+func newRuleScreener(path string) (*ruleScreener, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	screener := &ruleScreener{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// \b only holds next to a word character, "c++" ends in none
+		expression := regexp.QuoteMeta(line)
+		if wordCharPattern.MatchString(line[:1]) {
+			expression = `\b` + expression
+		}
+		if wordCharPattern.MatchString(line[len(line)-1:]) {
+			expression += `\b`
+		}
+		if pattern, is_regexp := strings.CutPrefix(line, "re:"); is_regexp {
+			expression = pattern
+		}
+		rule, err := regexp.Compile("(?i)" + expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", line, err)
+		}
+		screener.rules = append(screener.rules, rule)
+	}
+
+	return screener, scanner.Err()
+}
+
+func (s *ruleScreener) Name() string {
+	return "rules"
+}
+
+func (s *ruleScreener) Screen(ctx context.Context, text ScreenText) (ScreenResult, error) {
+	for _, rule := range s.rules {
+		if rule.MatchString(text.Title) || rule.MatchString(text.Description) {
+			return ScreenResult{Hold: true, Reasons: []string{"blocked word or phrase"}}, nil
+		}
+	}
+
+	return ScreenResult{}, nil
+}
+
+var urlPattern = regexp.MustCompile(`(?i)\b(https?://|www\.)\S+|\b[a-z0-9-]+\.(com|net|org|io|co|biz|info|xyz|ru|top|click)\b`)
+
+// Digits with the usual separators in between, checked further by
+// containsPhoneNumber
+var phonePattern = regexp.MustCompile(`\+?\(?\d[\d\s.\-()]*\d`)
+
+// Dates, times and year ranges have as many digits as a phone number
+var datePattern = regexp.MustCompile(`\b\d{4}[-./]\d{1,2}[-./]\d{1,2}(?:[T ]\d{1,2}:\d{2}(?::\d{2})?(?:\.\d+)?(?:Z|[+-]\d{2}:?\d{2})?)?\b|` +
+	`\b\d{1,2}[-./]\d{1,2}[-./]\d{2,4}\b|\b\d{1,2}:\d{2}(?::\d{2})?\b|\b(?:19|20)\d{2}\s*-\s*(?:19|20)?\d{2}\b`)
+
+// Amounts like 1.000.000 or 250,000
+var groupedNumberPattern = regexp.MustCompile(`^\d{1,3}(?:[.,\s]\d{3})+$`)
+
+// Whether text has 7 to 15 digits shaped like a phone number, once dates and
+// amounts are left out
+func containsPhoneNumber(text string) bool {
+	text = datePattern.ReplaceAllString(text, " ")
+	for _, match := range phonePattern.FindAllString(text, -1) {
+		match = strings.TrimSpace(match)
+		if groupedNumberPattern.MatchString(match) {
+			continue
+		}
+
+		digits := 0
+		for _, r := range match {
+			if r >= '0' && r <= '9' {
+				digits++
+			}
+		}
+		if digits >= 7 && digits <= 15 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Tasks are things to do somewhere, links and phone numbers in them are
+// almost always advertising
+type spamScreener struct{}
+
+func (s spamScreener) Name() string {
+	return "spam"
+}
+
+func (s spamScreener) Screen(ctx context.Context, text ScreenText) (ScreenResult, error) {
+	result := ScreenResult{}
+	for _, field := range []string{text.Title, text.Description} {
+		if urlPattern.MatchString(field) {
+			result.Reasons = append(result.Reasons, "contains a link")
+			break
+		}
+	}
+	for _, field := range []string{text.Title, text.Description} {
+		if containsPhoneNumber(field) {
+			result.Reasons = append(result.Reasons, "contains a phone number")
+			break
+		}
+	}
+	result.Hold = len(result.Reasons) > 0
+
+	return result, nil
+}
+
+// External classifier behind SCREEN_WEBHOOK_URL. It receives the ScreenText
+// as JSON and answers with a ScreenResult
+type webhookScreener struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookScreener) Name() string {
+	return "webhook"
+}
+
+func (s *webhookScreener) Screen(ctx context.Context, text ScreenText) (ScreenResult, error) {
+	text_json, err := json.Marshal(text)
+	if err != nil {
+		return ScreenResult{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(text_json))
+	if err != nil {
+		return ScreenResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return ScreenResult{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ScreenResult{}, fmt.Errorf("classifier returned %s", resp.Status)
+	}
+
+	var result ScreenResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result, err
+}
+
+// Build the pipeline from the environment. The spam checks always run
+func initTextScreeners() error {
+	registerTextScreener(spamScreener{})
+
+	if path := config.ScreenRulesFile; path != "" {
+		screener, err := newRuleScreener(path)
+		if err != nil {
+			return fmt.Errorf("could not load screening rules: %v", err)
+		}
+		registerTextScreener(screener)
+	}
+
+	if url := config.ScreenWebhookURL; url != "" {
+		registerTextScreener(&webhookScreener{
+			url:    url,
+			client: &http.Client{Timeout: 3 * time.Second},
+		})
+	}
+
+	return nil
+}
+
+// Run every screener and hold if any of them asks to. A screener that
+// fails is skipped so an outage doesn't block posting
+func screenText(text ScreenText) ScreenResult {
+	if !config.Features.Screening {
+		return ScreenResult{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result := ScreenResult{}
+	for _, screener := range textScreeners {
+		screener_result, err := screener.Screen(ctx, text)
+		if err != nil {
+			slog.Warn("text screener failed", "screener", screener.Name(), "error", err)
+			continue
+		}
+		if screener_result.Hold {
+			result.Hold = true
+			for _, reason := range screener_result.Reasons {
+				result.Reasons = append(result.Reasons, fmt.Sprintf("%s: %s", screener.Name(), reason))
+			}
+		}
+	}
+
+	return result
+}
+
+// Hide a task and put it in the moderation queue. Moderators publish it
+// by restoring it
+func holdTask(tx pgx.Tx, task_id int, result ScreenResult) error {
+	_, err := tx.Exec(context.Background(), `
+		UPDATE task SET hidden = true WHERE id = $1
+	`, task_id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(context.Background(), `
+		INSERT INTO report (target_type, target_id, reporter, reason, details)
+		VALUES ('task', $1, 'system:screening', 'screening', $2)
+		ON CONFLICT (target_type, target_id, reporter)
+		DO UPDATE SET details = $2, created = now(), status = 'open'
+	`, task_id, strings.Join(result.Reasons, "; "))
+
+	return err
+}
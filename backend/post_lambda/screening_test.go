@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpamScreener(t *testing.T) {
+	tests := []struct {
+		name string
+		text ScreenText
+		hold bool
+	}{
+		{"plain task", ScreenText{Title: "Watch the sunset", Description: "Bring a blanket"}, false},
+		{"link", ScreenText{Title: "Free stuff", Description: "see https://example.com/offer"}, true},
+		{"bare domain", ScreenText{Title: "Visit cheap-pills.biz now"}, true},
+		{"phone number", ScreenText{Description: "Call 555 123 4567 for tickets"}, true},
+		{"international phone number", ScreenText{Description: "WhatsApp +49 30 1234567"}, true},
+		{"phone number with area code", ScreenText{Title: "(030) 123-4567"}, true},
+		{"phone number without separators", ScreenText{Description: "text 07700900123"}, true},
+		{"ISO date", ScreenText{Description: "Meet on 2024-05-01"}, false},
+		{"ISO timestamp", ScreenText{Description: "Starts 2024-05-01T18:30:00Z sharp"}, false},
+		{"European date", ScreenText{Description: "Until 01.05.2024, 18:00 - 21:00"}, false},
+		{"year range", ScreenText{Title: "Reunion of the 2019 - 2024 class"}, false},
+		{"amount", ScreenText{Description: "Help count to 1.000.000 steps"}, false},
+		{"short number", ScreenText{Title: "Climb 120 steps"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := spamScreener{}.Screen(context.Background(), test.text)
+			if err != nil {
+				t.Fatalf("Screen returned error: %v", err)
+			}
+			if result.Hold != test.hold {
+				t.Errorf("Hold = %t, want %t (reasons: %v)", result.Hold, test.hold, result.Reasons)
+			}
+		})
+	}
+}
+
+func TestRuleScreener(t *testing.T) {
+	rules := "# comment\n\nscam\nre:buy\\s+followers\nfree c++\n"
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	screener, err := newRuleScreener(path)
+	if err != nil {
+		t.Fatalf("newRuleScreener returned error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		text ScreenText
+		hold bool
+	}{
+		{"no match", ScreenText{Title: "Feed the ducks"}, false},
+		{"word in title", ScreenText{Title: "Not a SCAM"}, true},
+		{"word in description", ScreenText{Description: "this is a scam."}, true},
+		{"word inside another word", ScreenText{Title: "Scampi tasting"}, false},
+		{"expression", ScreenText{Description: "Buy   followers here"}, true},
+		{"word with special characters", ScreenText{Title: "Free C++ lessons"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := screener.Screen(context.Background(), test.text)
+			if err != nil {
+				t.Fatalf("Screen returned error: %v", err)
+			}
+			if result.Hold != test.hold {
+				t.Errorf("Hold = %t, want %t", result.Hold, test.hold)
+			}
+		})
+	}
+}
+
+func TestRuleScreenerInvalidRule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	if err := os.WriteFile(path, []byte("re:(unclosed\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newRuleScreener(path); err == nil {
+		t.Error("newRuleScreener accepted an invalid expression")
+	}
+}
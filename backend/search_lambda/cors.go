@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const corsAllowMethods = "GET, OPTIONS"
+
+const corsAllowHeaders = "Content-Type, Authorization, X-Device-Id, X-Amz-Date, X-Api-Key, X-Amz-Security-Token"
+
+// Response headers scripts on another origin may read
+const corsExposeHeaders = "Content-Disposition, X-Next-Cursor"
+
+// Browsers may cache a preflight for this many seconds
+const corsMaxAge = "600"
+
+// Header lookup ignoring case, API Gateway passes names as the client sent
+// them
+func requestHeader(request events.APIGatewayProxyRequest, name string) string {
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// Value for Access-Control-Allow-Origin, if the origin may call the API.
+// Listed origins are echoed and may send credentials, a "*" entry lets any
+// origin in without them
+func corsAllowOrigin(origin string) (string, bool, bool) {
+	if origin == "" {
+		return "", false, false
+	}
+	if slices.Contains(config.CORSOrigins, origin) {
+		return origin, true, true
+	}
+	if slices.Contains(config.CORSOrigins, "*") {
+		return "*", false, true
+	}
+
+	return "", false, false
+}
+
+// Add the CORS headers for origin to headers, keeping the ones already set
+func setCORSHeaders(headers map[string]string, origin string) {
+	// Caches must not serve the response for one origin to another
+	if vary, exists := headers["Vary"]; exists && vary != "" {
+		headers["Vary"] = vary + ", Origin"
+	} else {
+		headers["Vary"] = "Origin"
+	}
+
+	allow_origin, credentials, allowed := corsAllowOrigin(origin)
+	if !allowed {
+		return
+	}
+	headers["Access-Control-Allow-Origin"] = allow_origin
+	headers["Access-Control-Expose-Headers"] = corsExposeHeaders
+	if credentials {
+		headers["Access-Control-Allow-Credentials"] = "true"
+	}
+}
+
+// Answer preflight requests and add CORS headers to every other response
+// for origins in CORS_ORIGINS. Errors of the handler become a 500
+func corsMiddleware(next func(events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) func(events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		origin := requestHeader(request, "Origin")
+
+		if request.HTTPMethod == "OPTIONS" {
+			if _, _, allowed := corsAllowOrigin(origin); !allowed {
+				return events.APIGatewayProxyResponse{
+					StatusCode: 403,
+					Body:       "Origin not allowed",
+					Headers: map[string]string{
+						"Content-Type": "text/plain",
+						"Vary":         "Origin",
+					},
+				}, nil
+			}
+
+			headers := map[string]string{
+				"Access-Control-Allow-Methods": corsAllowMethods,
+				"Access-Control-Allow-Headers": corsAllowHeaders,
+				"Access-Control-Max-Age":       corsMaxAge,
+			}
+			setCORSHeaders(headers, origin)
+			return events.APIGatewayProxyResponse{
+				StatusCode: 204,
+				Headers:    headers,
+			}, nil
+		}
+
+		response, err := next(request)
+		if err != nil {
+			response = events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       fmt.Sprintf("Internal server error: %v", err),
+				Headers: map[string]string{
+					"Content-Type": "text/plain",
+				},
+			}
+		}
+
+		// Keep headers such as Content-Type set by the handler
+		if response.Headers == nil {
+			response.Headers = map[string]string{}
+		}
+		setCORSHeaders(response.Headers, origin)
+
+		return response, nil
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Exports are paged like searches, with larger pages. The cursor for the
+// next page comes in the X-Next-Cursor header
+const maxExportTasks = 1000
+
+// Lambda responses can't exceed 6 MB, a page ends early once its body
+// passes this size
+const maxExportBytes = 4 << 20
+
+// Tasks are written in batches so their images can be looked up together
+const exportBatchSize = 50
+
+var exportContentTypes = map[string]string{
+	"geojson": "application/geo+json",
+	"kml":     "application/vnd.google-earth.kml+xml",
+}
+
+type geoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+type exportProperties struct {
+	SearchRet
+	Images []string `json:"images"`
+}
+
+type geoJSONFeature struct {
+	Type       string           `json:"type"`
+	Id         int              `json:"id"`
+	Geometry   geoJSONPoint     `json:"geometry"`
+	Properties exportProperties `json:"properties"`
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlCData struct {
+	Value string `xml:",cdata"`
+}
+
+type kmlPlacemark struct {
+	XMLName     xml.Name  `xml:"Placemark"`
+	Id          string    `xml:"id,attr"`
+	Name        string    `xml:"name"`
+	Address     string    `xml:"address,omitempty"`
+	Description kmlCData  `xml:"description"`
+	Begin       string    `xml:"TimeSpan>begin"`
+	End         string    `xml:"TimeSpan>end"`
+	Data        []kmlData `xml:"ExtendedData>Data"`
+	Coordinates string    `xml:"Point>coordinates"`
+}
+
+// Read the format parameter of a listing, "" meaning the usual JSON page
+func getExportFormat(request events.APIGatewayProxyRequest) (string, *events.APIGatewayProxyResponse) {
+	format := request.QueryStringParameters["format"]
+	switch format {
+	case "", "json":
+		return "", nil
+	case "geojson", "kml":
+		if !config.Features.Exports {
+			return "", &events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       "Invalid parameters: format (exports are disabled)",
+				Headers: map[string]string{
+					"Content-Type": "text/plain",
+				},
+			}
+		}
+		return format, nil
+	default:
+		return "", &events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid parameters: format (must be json, geojson or kml)",
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+}
+
+// Writes tasks as a GeoJSON FeatureCollection or KML document one batch at
+// a time. API Gateway proxy responses can't be streamed, so the page is
+// built in memory and returned whole
+type taskExport struct {
+	format  string
+	out     *strings.Builder
+	count   int
+	pending []SearchRet
+}
+
+func newTaskExport(format string, out *strings.Builder) *taskExport {
+	return &taskExport{
+		format: format,
+		out:    out,
+	}
+}
+
+func (e *taskExport) begin() error {
+	var err error
+	switch e.format {
+	case "geojson":
+		_, err = e.out.WriteString(`{"type":"FeatureCollection","features":[`)
+	case "kml":
+		_, err = e.out.WriteString(xml.Header + `<kml xmlns="http://www.opengis.net/kml/2.2"><Document><name>spontaniapp tasks</name>`)
+	}
+	return err
+}
+
+func (e *taskExport) add(task SearchRet) error {
+	e.pending = append(e.pending, task)
+	if len(e.pending) == exportBatchSize {
+		return e.flush()
+	}
+	return nil
+}
+
+// Signed download link for an uploaded image
+func presignImageURL(id int) (string, error) {
+	presigned_req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(config.ImageBucket),
+		Key:    aws.String(fmt.Sprintf("%d", id)),
+	})
+	return presigned_req.Presign(config.ImageURLTTL)
+}
+
+// Signed image links of every pending task, in upload order
+func (e *taskExport) pendingImages() (map[int][]string, error) {
+	task_ids := make([]int, len(e.pending))
+	for i, task := range e.pending {
+		task_ids[i] = task.Id
+	}
+
+	rows, err := dbConn.Query(context.Background(), `
+		SELECT id, task_id FROM img
+			WHERE task_id = ANY($1) AND NOT hidden
+			ORDER BY task_id, uploaded, id
+	`, task_ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := map[int][]string{}
+	for rows.Next() {
+		var id, task_id int
+		if err := rows.Scan(&id, &task_id); err != nil {
+			return nil, err
+		}
+
+		url, err := presignImageURL(id)
+		if err != nil {
+			return nil, err
+		}
+		images[task_id] = append(images[task_id], url)
+	}
+
+	return images, rows.Err()
+}
+
+func (e *taskExport) flush() error {
+	if len(e.pending) == 0 {
+		return nil
+	}
+
+	images, err := e.pendingImages()
+	if err != nil {
+		return err
+	}
+
+	for _, task := range e.pending {
+		task_images := images[task.Id]
+		if task_images == nil {
+			task_images = []string{}
+		}
+
+		switch e.format {
+		case "geojson":
+			err = e.writeGeoJSON(task, task_images)
+		case "kml":
+			err = e.writeKML(task, task_images)
+		}
+		if err != nil {
+			return err
+		}
+		e.count++
+	}
+
+	e.pending = e.pending[:0]
+	return nil
+}
+
+func (e *taskExport) writeGeoJSON(task SearchRet, images []string) error {
+	if e.count > 0 {
+		if err := e.out.WriteByte(','); err != nil {
+			return err
+		}
+	}
+
+	feature_json, err := json.Marshal(geoJSONFeature{
+		Type: "Feature",
+		Id:   task.Id,
+		Geometry: geoJSONPoint{
+			Type:        "Point",
+			Coordinates: [2]float64{task.Lng, task.Lat},
+		},
+		Properties: exportProperties{
+			SearchRet: task,
+			Images:    images,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = e.out.Write(feature_json)
+	return err
+}
+
+func (e *taskExport) writeKML(task SearchRet, images []string) error {
+	// Google Earth shows the description as HTML in the placemark balloon
+	description := html.EscapeString(task.Description)
+	for _, url := range images {
+		description += fmt.Sprintf(`<br><img src="%s" width="300">`, html.EscapeString(url))
+	}
+
+	data := []kmlData{
+		{Name: "id", Value: fmt.Sprintf("%d", task.Id)},
+		{Name: "location_name", Value: task.LocationName},
+		{Name: "status", Value: task.Status},
+		{Name: "likes", Value: fmt.Sprintf("%d", task.Likes)},
+		{Name: "time_zone", Value: task.TimeZone},
+		{Name: "start_local", Value: task.StartLocal},
+		{Name: "stop_local", Value: task.StopLocal},
+	}
+	if task.RRule != "" {
+		data = append(data, kmlData{Name: "rrule", Value: task.RRule})
+	}
+	if task.Distance != nil {
+		data = append(data, kmlData{Name: "distance", Value: fmt.Sprintf("%.0f", *task.Distance)})
+	}
+	for i, url := range images {
+		data = append(data, kmlData{Name: fmt.Sprintf("image_%d", i+1), Value: url})
+	}
+
+	placemark_xml, err := xml.Marshal(kmlPlacemark{
+		Id:          fmt.Sprintf("task-%d", task.Id),
+		Name:        task.Title,
+		Address:     task.LocationAddress,
+		Description: kmlCData{description},
+		Begin:       time.Unix(task.Start, 0).UTC().Format(time.RFC3339),
+		End:         time.Unix(task.Stop, 0).UTC().Format(time.RFC3339),
+		Data:        data,
+		Coordinates: fmt.Sprintf("%f,%f", task.Lng, task.Lat),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = e.out.Write(placemark_xml)
+	return err
+}
+
+func (e *taskExport) end() error {
+	if err := e.flush(); err != nil {
+		return err
+	}
+
+	var err error
+	switch e.format {
+	case "geojson":
+		_, err = e.out.WriteString("]}")
+	case "kml":
+		_, err = e.out.WriteString("</Document></kml>")
+	}
+	return err
+}
+
+// Export one page of search results, starting after the cursor parameter if
+// given
+func exportSearchResults(request events.APIGatewayProxyRequest, query searchQuery, format string) events.APIGatewayProxyResponse {
+	cursor, res := getCursorParameter(request, query.Sort)
+	if res != nil {
+		return *res
+	}
+
+	// Fetch one extra row to know whether another page exists
+	rows, err := querySearchRows(query, cursor, maxExportTasks+1)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+	defer rows.Close()
+
+	var body strings.Builder
+	export := newTaskExport(format, &body)
+	err = export.begin()
+
+	occurrences_from, occurrences_to := getOccurrenceRange(request)
+	var next_cursor, last_sort_key, last_tiebreak_key string
+	var last_id int
+	for err == nil && rows.Next() {
+		var result SearchRet
+		var sort_key string
+		var tiebreak_key *string
+		task, res := parseTask(rows, &result.Rank, &result.TitleHighlight, &result.LocationNameHighlight, &result.DescriptionHighlight, &result.Distance, &sort_key, &tiebreak_key)
+		if res != nil {
+			return *res
+		}
+		expandOccurrences(&task, occurrences_from, occurrences_to)
+		result.TaskRet = task
+
+		// The body only grows when a batch is written, so nothing is
+		// pending once it is too large
+		if export.count+len(export.pending) == maxExportTasks || body.Len() >= maxExportBytes {
+			next_cursor = encodeCursor(pageCursor{
+				Sort:        query.Sort.Name,
+				SortKey:     last_sort_key,
+				TiebreakKey: last_tiebreak_key,
+				Id:          last_id,
+			})
+			break
+		}
+
+		err = export.add(result)
+		last_sort_key = sort_key
+		last_tiebreak_key = ""
+		if tiebreak_key != nil {
+			last_tiebreak_key = *tiebreak_key
+		}
+		last_id = task.Id
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err == nil {
+		err = export.end()
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Export error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	headers := map[string]string{
+		"Content-Type":        exportContentTypes[format],
+		"Content-Disposition": fmt.Sprintf("attachment; filename=\"tasks.%s\"", format),
+	}
+	if next_cursor != "" {
+		headers["X-Next-Cursor"] = next_cursor
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       body.String(),
+		Headers:    headers,
+	}
+}
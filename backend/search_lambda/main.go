@@ -4,9 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
 	"strconv"
+	"strings"
 	"time"
+	_ "time/tzdata"
+	"unicode"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -15,7 +17,6 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/joho/godotenv"
 	"googlemaps.github.io/maps"
 )
 
@@ -24,50 +25,230 @@ var s3Client *s3.S3
 var dbConn *pgxpool.Pool
 
 type TaskRet struct {
-	Id           int     `json:"id"`
-	Title        string  `json:"title"`
-	Description  string  `json:"description"`
-	Lat          float64 `json:"lat"`
-	Lng          float64 `json:"lng"`
-	Uploaded     int64   `json:"uploaded"`
-	Start        int64   `json:"start"`
-	Stop         int64   `json:"stop"`
-	InitialImgId int     `json:"initial_img_id"`
-	Likes        int     `json:"likes"`
+	Id              int     `json:"id"`
+	Title           string  `json:"title"`
+	LocationName    string  `json:"location_name"`
+	LocationAddress string  `json:"location_address"`
+	Description     string  `json:"description"`
+	Lat             float64 `json:"lat"`
+	Lng             float64 `json:"lng"`
+	Uploaded        int64   `json:"uploaded"`
+	Start           int64   `json:"start"`
+	Stop            int64   `json:"stop"`
+	InitialImgId    int     `json:"initial_img_id"`
+	Likes           int     `json:"likes"`
+	NumComments     int     `json:"num_comments"`
+	Status          string  `json:"status"`
+	// Submission with the most reactions, if any has one
+	TopImgId *int `json:"top_img_id"`
+	// Recurring tasks only, as an iCalendar RRULE and seconds per occurrence
+	RRule       string          `json:"rrule,omitempty"`
+	Duration    int64           `json:"duration,omitempty"`
+	Occurrences []OccurrenceRet `json:"occurrences,omitempty"`
+	// IANA zone of the task location, with start and stop as local ISO-8601
+	TimeZone   string `json:"time_zone"`
+	StartLocal string `json:"start_local"`
+	StopLocal  string `json:"stop_local"`
+}
+
+type SearchRet struct {
+	TaskRet
+	Rank float64 `json:"rank"`
+	// HTML-safe: the text is escaped and matches are wrapped in <mark>
+	TitleHighlight        string   `json:"title_highlight"`
+	LocationNameHighlight string   `json:"location_name_highlight"`
+	DescriptionHighlight  string   `json:"description_highlight"`
+	Distance              *float64 `json:"distance,omitempty"` // meters
 }
 
 func init() {
-	// Load environment variables
-	err := godotenv.Load()
+	var err error
+	config, err = loadConfig()
 	if err != nil {
-		fmt.Println("Error loading .env file, proceeding without it...")
+		panic(err)
 	}
+	initLogger()
 
 	// Initialize Google Maps client
-	mapsClient, err = maps.NewClient(maps.WithAPIKey(os.Getenv("GOOGLE_MAPS_KEY")))
+	mapsClient, err = maps.NewClient(maps.WithAPIKey(config.GoogleMapsKey))
 	if err != nil {
 		panic(fmt.Sprintf("Failed to create Google Maps client: %v", err))
 	}
 
-	s3Client = s3.New(session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(os.Getenv("S3_REGION")),
-		Credentials: credentials.NewStaticCredentials(
-			os.Getenv("AWS_ACCESS_KEY_ID"),
-			os.Getenv("AWS_SECRET_ACCESS_KEY"),
-			"",
-		),
-	})))
+	aws_config := &aws.Config{
+		Region: aws.String(config.S3Region),
+	}
+	if config.AWSAccessKeyId != "" {
+		aws_config.Credentials = credentials.NewStaticCredentials(config.AWSAccessKeyId, config.AWSSecretAccessKey, "")
+	}
+	s3Client = s3.New(session.Must(session.NewSession(aws_config)))
 
-	pgx_config, err := pgxpool.ParseConfig(os.Getenv("DATABASE_URL"))
+	pgx_config, err := pgxpool.ParseConfig(config.DatabaseURL)
 	if err != nil {
-		panic(fmt.Sprintf("Invalid databse URL: %v", os.Getenv("DATABASE_URL")))
+		panic(fmt.Sprintf("Invalid database URL: %v", err))
 	}
-	pgx_config.MaxConns = 32
-	pgx_config.ConnConfig.ConnectTimeout = 10 * time.Second
+	pgx_config.MaxConns = int32(config.DBMaxConns)
+	pgx_config.ConnConfig.ConnectTimeout = config.DBConnectTimeout
+	pgx_config.ConnConfig.Tracer = dbMetricsTracer{}
 	dbConn, err = pgxpool.NewWithConfig(context.Background(), pgx_config)
 	if err != nil {
-		panic(fmt.Sprintf("Could not connect to database: %v", os.Getenv("DATABASE_URL")))
+		panic(fmt.Sprintf("Could not connect to database: %v", err))
+	}
+}
+
+// Identify the caller the same way post_lambda does, for the logs
+func getRequestUser(request events.APIGatewayProxyRequest) string {
+	if principal, ok := request.RequestContext.Authorizer["principalId"].(string); ok && principal != "" {
+		return principal
+	}
+
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, "X-Device-Id") && value != "" {
+			return "device:" + value
+		}
+	}
+
+	return ""
+}
+
+func getLatLngParameters(request events.APIGatewayProxyRequest) (float64, float64, *events.APIGatewayProxyResponse) {
+	lat_str, lat_exists := request.QueryStringParameters["lat"]
+	lng_str, lng_exists := request.QueryStringParameters["lng"]
+	if !lat_exists || !lng_exists {
+		return 0, 0, &events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Missing required parameters: lat, lng",
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	lat, lat_err := strconv.ParseFloat(lat_str, 64)
+	lng, lng_err := strconv.ParseFloat(lng_str, 64)
+	if lat_err != nil || lng_err != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return 0, 0, &events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid required parameters: lat, lng",
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	return lat, lng, nil
+}
+
+// Turn free-form user input into a tsquery where every word must match and
+// each word also matches as a prefix, so "sun pie" finds "sunset at the pier"
+func buildPrefixTsQuery(q string) string {
+	words := strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	terms := []string{}
+	for _, word := range words {
+		terms = append(terms, word+":*")
+	}
+
+	return strings.Join(terms, " & ")
+}
+
+// Active tasks count as ending soon once less than this much time is left
+const endingSoonWindow = time.Hour
+
+// Status of a task at the given time: upcoming, active, ending_soon or completed
+func taskStatus(start time.Time, stop time.Time, now time.Time) string {
+	switch {
+	case now.Before(start):
+		return "upcoming"
+	case !now.Before(stop):
+		return "completed"
+	case stop.Sub(now) <= endingSoonWindow:
+		return "ending_soon"
+	default:
+		return "active"
+	}
+}
+
+// Load a task's time zone, falling back to UTC for unknown names
+func taskLocation(time_zone string) *time.Location {
+	location, err := time.LoadLocation(time_zone)
+	if err != nil {
+		return time.UTC
+	}
+
+	return location
+}
+
+func formatLocalTime(unix int64, location *time.Location) string {
+	return time.Unix(unix, 0).In(location).Format(time.RFC3339)
+}
+
+type RowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func parseTask(row RowScanner, extra ...interface{}) (TaskRet, *events.APIGatewayProxyResponse) {
+	var id int
+	var title string
+	var location_name string
+	var location_address string
+	var description string
+	var lat float64
+	var lng float64
+	var uploaded time.Time
+	var start time.Time
+	var stop time.Time
+	var initial_img_id int
+	var likes int
+	var rrule string
+	var duration int64
+	var time_zone string
+	var num_comments int
+	var top_img_id *int
+	dest := []interface{}{&id, &title, &location_name, &location_address, &description, &lat, &lng, &uploaded, &start, &stop, &initial_img_id, &likes, &rrule, &duration, &time_zone, &num_comments, &top_img_id}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return TaskRet{}, &events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
 	}
+
+	return TaskRet{
+		Id:              id,
+		Title:           title,
+		LocationName:    location_name,
+		LocationAddress: location_address,
+		Description:     description,
+		Lat:             lat,
+		Lng:             lng,
+		Uploaded:        uploaded.Unix(),
+		Start:           start.Unix(),
+		Stop:            stop.Unix(),
+		InitialImgId:    initial_img_id,
+		Likes:           likes,
+		NumComments:     num_comments,
+		TopImgId:        top_img_id,
+		Status:          taskStatus(start, stop, time.Now()),
+		RRule:           rrule,
+		Duration:        duration,
+		TimeZone:        time_zone,
+		StartLocal:      formatLocalTime(start.Unix(), taskLocation(time_zone)),
+		StopLocal:       formatLocalTime(stop.Unix(), taskLocation(time_zone)),
+	}, nil
+}
+
+// Request types the handler serves, the only ones given their own metrics.
+// Keep in step with its switch
+var knownRequestTypes = map[string]bool{
+	"get_google_maps_key":     true,
+	"get_nearby_recent_tasks": true,
+	"search_tasks":            true,
 }
 
 func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
@@ -76,144 +257,100 @@ func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRespo
 		return events.APIGatewayProxyResponse{
 			StatusCode: 400,
 			Body:       "Missing required parameter: request_type",
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
 		}, nil
 	}
 
 	switch request_type {
 	case "get_google_maps_key":
-		return events.APIGatewayProxyResponse{
-			StatusCode: 200,
-			Body:       os.Getenv("DATABASE_URL"),
-		}, nil
+		return getBrowserMapsKey(), nil
 	case "get_nearby_recent_tasks":
-		lat_str, lat_exists := request.QueryStringParameters["lat"]
-		lng_str, lng_exists := request.QueryStringParameters["lng"]
-		if !lat_exists || !lng_exists {
-			return events.APIGatewayProxyResponse{
-				StatusCode: 400,
-				Body:       "Missing required parameters: lat, lng",
-			}, nil
+		lat, lng, res := getLatLngParameters(request)
+		if res != nil {
+			return *res, nil
 		}
 
-		lat, lat_err := strconv.ParseFloat(lat_str, 64)
-		lng, lng_err := strconv.ParseFloat(lng_str, 64)
-		if lat_err != nil || lng_err != nil {
+		query := searchQuery{}
+		point := fmt.Sprintf("ST_SetSRID(ST_MakePoint(%s, %s), 4326)::geography", query.arg(lng), query.arg(lat))
+		query.Where = []string{"occurrence_stop > now()"}
+		query.Distance = fmt.Sprintf("ST_Distance(location, %s)", point)
+		query.Sort = taskSort{Name: distanceSortName(lat, lng), Expr: query.Distance, Type: "double precision"}
+
+		return querySearchPage(request, query), nil
+	case "search_tasks":
+		q, q_exists := request.QueryStringParameters["q"]
+		if !q_exists || strings.TrimSpace(q) == "" {
 			return events.APIGatewayProxyResponse{
 				StatusCode: 400,
-				Body:       "Invalid required parameters: lat, lng",
+				Body:       "Missing required parameter: q",
+				Headers: map[string]string{
+					"Content-Type": "text/plain",
+				},
 			}, nil
 		}
 
-		rows, err := dbConn.Query(context.Background(), `
-			SELECT id, title, description, lat, lng, uploaded,
-				start, stop, initial_img_id, likes,
-				point($1, $2) <@>  (point(lat, lng)::point) as distance
-				FROM task ORDER BY distance ASC
-		`, lat, lng)
-		if err != nil {
+		query := searchQuery{
+			TsQuery: buildPrefixTsQuery(q),
+		}
+		if query.TsQuery == "" {
+			// Nothing searchable left after stripping punctuation
+			page_json, _ := json.Marshal([]SearchRet{})
 			return events.APIGatewayProxyResponse{
-				StatusCode: 500,
-				Body:       fmt.Sprintf("Database error: %v", err),
+				StatusCode: 200,
+				Body:       string(page_json),
+				Headers: map[string]string{
+					"Content-Type": "application/json",
+				},
 			}, nil
 		}
-		defer rows.Close()
-
-		tasks := []TaskRet{}
-		for rows.Next() {
-			var id int
-			var title string
-			var description string
-			var lat float64
-			var lng float64
-			var uploaded int64
-			var start int64
-			var stop int64
-			var initial_img_id int
-			var likes int
-			var distance float64
-			err := rows.Scan(&id, &title, &description, &lat, &lng, &uploaded, &start, &stop, &initial_img_id, &likes, &distance)
-			if err != nil {
-				return events.APIGatewayProxyResponse{
-					StatusCode: 500,
-					Body:       fmt.Sprintf("Database error: %v", err),
-				}, nil
-			}
-			tasks = append(tasks, TaskRet{
-				Id:           id,
-				Title:        title,
-				Description:  description,
-				Lat:          lat,
-				Lng:          lng,
-				Uploaded:     uploaded,
-				Start:        start,
-				Stop:         stop,
-				InitialImgId: initial_img_id,
-				Likes:        likes,
-			})
+		query.Where = []string{"search @@ query"}
+
+		// Completed tasks are only searched when asked for
+		if request.QueryStringParameters["include_completed"] != "true" {
+			query.Where = append(query.Where, "occurrence_stop > now()")
 		}
 
-		tasks_json, err := json.Marshal(tasks)
-		if err != nil {
-			return events.APIGatewayProxyResponse{
-				StatusCode: 500,
-				Body:       fmt.Sprintf("JSON marshalling error: %v", err),
-			}, nil
+		// With a location, order by distance instead of rank, equally distant
+		// tasks by rank
+		query.Sort = taskSort{Name: "rank", Expr: "ts_rank_cd(search, query)::double precision", Type: "double precision", Desc: true}
+		if _, lat_exists := request.QueryStringParameters["lat"]; lat_exists {
+			lat, lng, res := getLatLngParameters(request)
+			if res != nil {
+				return *res, nil
+			}
+
+			point := fmt.Sprintf("ST_SetSRID(ST_MakePoint(%s, %s), 4326)::geography", query.arg(lng), query.arg(lat))
+			query.Distance = fmt.Sprintf("ST_Distance(location, %s)", point)
+			query.Sort = taskSort{
+				Name:     distanceSortName(lat, lng),
+				Expr:     query.Distance,
+				Type:     "double precision",
+				Tiebreak: "-ts_rank_cd(search, query)::double precision",
+			}
 		}
 
-		return events.APIGatewayProxyResponse{
-			StatusCode: 200,
-			Body:       string(tasks_json),
-		}, nil
+		return querySearchPage(request, query), nil
 	default:
 		return events.APIGatewayProxyResponse{
 			StatusCode: 400,
 			Body:       "Incorrect parameter value: request_type",
-		}, nil
-	}
-
-	// // Perform Nearby Search
-	// response, err := mapsClient.NearbySearch(context.Background(), &maps.NearbySearchRequest{
-	// 	Location: &maps.LatLng{
-	// 		Lat: lat,
-	// 		Lng: lng,
-	// 	},
-	// 	Radius: uint(10), // Adjust radius as needed
-	// })
-	// if err != nil {
-	// 	return Response{
-	// 		StatusCode: 500,
-	// 		Body:       nil,
-	// 	}, fmt.Errorf("failed to perform Nearby Search: %v", err)
-	// }
-
-	// // Return results as JSON
-	// return Response{
-	// 	StatusCode: 200,
-	// 	Body:       response.Results,
-	// }, nil
-}
-
-func corsHandlerWrapper(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	response, err := handler(request)
-	if err != nil {
-		return events.APIGatewayProxyResponse{
-			StatusCode: 500,
-			Body:       fmt.Sprintf("Internal server error: %v", err),
 			Headers: map[string]string{
 				"Content-Type": "text/plain",
 			},
 		}, nil
 	}
-
-	response.Headers = map[string]string{}
-	response.Headers["Access-Control-Allow-Origin"] = "*"
-	response.Headers["Access-Control-Allow-Headers"] = "*"
-	response.Headers["Access-Control-Allow-Methods"] = "*"
-	response.Headers["Access-Control-Allow-Credentials"] = "true"
-
-	return response, nil
 }
 
 func main() {
-	lambda.Start(corsHandlerWrapper)
+	wrapped_handler := metricsMiddleware(loggingMiddleware(corsMiddleware(handler)))
+	if config.LocalMode {
+		if err := runLocalServer(wrapped_handler); err != nil {
+			panic(fmt.Sprintf("Local server failed: %v", err))
+		}
+		return
+	}
+
+	lambda.Start(wrapped_handler)
 }
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Key for the Maps JavaScript API in the browser. It is a separate key
+// restricted by HTTP referrer, the server key in GOOGLE_MAPS_KEY is never
+// handed out
+func getBrowserMapsKey() events.APIGatewayProxyResponse {
+	if config.GoogleMapsBrowserKey == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 503,
+			Body:       "Maps are not configured",
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       config.GoogleMapsBrowserKey,
+		Headers: map[string]string{
+			"Content-Type": "text/plain",
+		},
+	}
+}
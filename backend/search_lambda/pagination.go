@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/jackc/pgx/v5"
+)
+
+const defaultPageLimit = 25
+const maxPageLimit = 100
+
+// Opaque cursor handed to clients in the X-Next-Cursor header. SortKey holds
+// the text form of the sort expression for the last row so it can be cast
+// back in SQL
+type pageCursor struct {
+	Sort    string `json:"s"`
+	SortKey string `json:"k"`
+	// Text form of the tiebreak expression, when the sort has one
+	TiebreakKey string `json:"t,omitempty"`
+	Id          int    `json:"id"`
+}
+
+type taskSort struct {
+	Name string
+	Expr string
+	// SQL type of Expr, used to cast cursor values back
+	Type string
+	Desc bool
+	// Optional expression of the same type ordering rows with equal Expr,
+	// in the same direction
+	Tiebreak string
+}
+
+type searchQuery struct {
+	// Prefix tsquery matched against task.search, empty for plain listings
+	TsQuery string
+	// Conditions ANDed together, referencing Args by position
+	Where []string
+	Args  []interface{}
+	// Optional SQL expression returned as the distance of each task
+	Distance string
+	Sort     taskSort
+}
+
+// Add a query argument and return its placeholder
+func (q *searchQuery) arg(value interface{}) string {
+	q.Args = append(q.Args, value)
+	return fmt.Sprintf("$%d", len(q.Args))
+}
+
+// Distances are only comparable from the same point, so a distance cursor is
+// bound to it
+func distanceSortName(lat float64, lng float64) string {
+	return fmt.Sprintf("distance@%g,%g", lat, lng)
+}
+
+func encodeCursor(cursor pageCursor) string {
+	cursor_json, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(cursor_json)
+}
+
+func decodeCursor(cursor_str string) (pageCursor, error) {
+	var cursor pageCursor
+	cursor_json, err := base64.RawURLEncoding.DecodeString(cursor_str)
+	if err != nil {
+		return cursor, err
+	}
+
+	err = json.Unmarshal(cursor_json, &cursor)
+	return cursor, err
+}
+
+func getPaginationParameters(request events.APIGatewayProxyRequest, sort taskSort) (int, *pageCursor, *events.APIGatewayProxyResponse) {
+	limit := defaultPageLimit
+	if limit_str, exists := request.QueryStringParameters["limit"]; exists {
+		var err error
+		limit, err = strconv.Atoi(limit_str)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return 0, nil, &events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf("Invalid parameter: limit (must be between 1 and %d)", maxPageLimit),
+				Headers: map[string]string{
+					"Content-Type": "text/plain",
+				},
+			}
+		}
+	}
+
+	cursor, res := getCursorParameter(request, sort)
+	if res != nil {
+		return 0, nil, res
+	}
+
+	return limit, cursor, nil
+}
+
+func getCursorParameter(request events.APIGatewayProxyRequest, sort taskSort) (*pageCursor, *events.APIGatewayProxyResponse) {
+	cursor_str, exists := request.QueryStringParameters["cursor"]
+	if !exists || cursor_str == "" {
+		return nil, nil
+	}
+
+	// A cursor is only valid for the ordering it was issued for
+	cursor, err := decodeCursor(cursor_str)
+	if err != nil || cursor.Sort != sort.Name {
+		return nil, &events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       "Invalid parameter: cursor",
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	return &cursor, nil
+}
+
+// SQL expression escaping the HTML special characters of column. ts_headline
+// keeps the escaped text as is, so its only markup is the <mark> it adds
+func escapeHTMLColumn(column string) string {
+	return fmt.Sprintf("replace(replace(replace(%s, '&', '&amp;'), '<', '&lt;'), '>', '&gt;')", column)
+}
+
+// Run a search query starting after cursor, if any. Rows hold the task
+// columns followed by rank, highlights, distance and the text forms of the
+// sort key and tiebreak
+func querySearchRows(query searchQuery, cursor *pageCursor, limit int) (pgx.Rows, error) {
+	from := "task"
+	rank_select := "0::double precision"
+	title_select := escapeHTMLColumn("title")
+	location_name_select := escapeHTMLColumn("location_name")
+	description_select := escapeHTMLColumn("description")
+	if query.TsQuery != "" {
+		from = fmt.Sprintf("task, to_tsquery('english', %s) query", query.arg(query.TsQuery))
+		rank_select = "ts_rank_cd(search, query)::double precision"
+		title_select = fmt.Sprintf(`ts_headline('english', %s, query,
+			'StartSel=<mark>, StopSel=</mark>, HighlightAll=true')`, title_select)
+		location_name_select = fmt.Sprintf(`ts_headline('english', %s, query,
+			'StartSel=<mark>, StopSel=</mark>, HighlightAll=true')`, location_name_select)
+		description_select = fmt.Sprintf(`ts_headline('english', %s, query,
+			'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=20, MinWords=5')`, description_select)
+	}
+
+	distance_select := "NULL::double precision"
+	if query.Distance != "" {
+		distance_select = query.Distance
+	}
+
+	direction, comparison := "ASC", ">"
+	if query.Sort.Desc {
+		direction, comparison = "DESC", "<"
+	}
+
+	// Moderators hide tasks from every listing
+	where := append([]string{"NOT hidden"}, query.Where...)
+	sort_exprs := []string{query.Sort.Expr}
+	tiebreak_select := "NULL::text"
+	if query.Sort.Tiebreak != "" {
+		sort_exprs = append(sort_exprs, query.Sort.Tiebreak)
+		tiebreak_select = fmt.Sprintf("(%s)::text", query.Sort.Tiebreak)
+	}
+	if cursor != nil {
+		cursor_values := []string{fmt.Sprintf("%s::text::%s", query.arg(cursor.SortKey), query.Sort.Type)}
+		if query.Sort.Tiebreak != "" {
+			cursor_values = append(cursor_values, fmt.Sprintf("%s::text::%s", query.arg(cursor.TiebreakKey), query.Sort.Type))
+		}
+		where = append(where, fmt.Sprintf("(%s, id) %s (%s, %s)",
+			strings.Join(sort_exprs, ", "), comparison, strings.Join(cursor_values, ", "), query.arg(cursor.Id)))
+	}
+
+	order_by := []string{}
+	for _, expr := range append(sort_exprs, "id") {
+		order_by = append(order_by, expr+" "+direction)
+	}
+
+	where_clause := ""
+	if len(where) > 0 {
+		where_clause = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	return dbConn.Query(context.Background(), fmt.Sprintf(`
+		SELECT id, title, location_name, location_address,
+			description, lat, lng, uploaded,
+			start, stop, initial_img_id, likes,
+			rrule, duration, time_zone, num_comments, top_img_id,
+			%s, %s, %s, %s, %s, (%s)::text, %s
+			FROM %s %s
+			ORDER BY %s
+			LIMIT %s
+	`, rank_select, title_select, location_name_select, description_select, distance_select, query.Sort.Expr,
+		tiebreak_select, from, where_clause, strings.Join(order_by, ", "), query.arg(limit)), query.Args...)
+}
+
+func querySearchPage(request events.APIGatewayProxyRequest, query searchQuery) events.APIGatewayProxyResponse {
+	format, res := getExportFormat(request)
+	if res != nil {
+		return *res
+	}
+	if format != "" {
+		return exportSearchResults(request, query, format)
+	}
+
+	limit, cursor, res := getPaginationParameters(request, query.Sort)
+	if res != nil {
+		return *res
+	}
+
+	// Fetch one extra row to know whether another page exists
+	rows, err := querySearchRows(query, cursor, limit+1)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+	defer rows.Close()
+
+	occurrences_from, occurrences_to := getOccurrenceRange(request)
+	// Listings stay a plain array, the cursor for the next page comes in the
+	// X-Next-Cursor header when there is one
+	page := []SearchRet{}
+	var next_cursor string
+	var last_sort_key, last_tiebreak_key string
+	for rows.Next() {
+		var result SearchRet
+		var sort_key string
+		var tiebreak_key *string
+		task, res := parseTask(rows, &result.Rank, &result.TitleHighlight, &result.LocationNameHighlight, &result.DescriptionHighlight, &result.Distance, &sort_key, &tiebreak_key)
+		if res != nil {
+			return *res
+		}
+		expandOccurrences(&task, occurrences_from, occurrences_to)
+		result.TaskRet = task
+
+		if len(page) == limit {
+			next_cursor = encodeCursor(pageCursor{
+				Sort:        query.Sort.Name,
+				SortKey:     last_sort_key,
+				TiebreakKey: last_tiebreak_key,
+				Id:          page[limit-1].Id,
+			})
+			break
+		}
+
+		page = append(page, result)
+		last_sort_key = sort_key
+		last_tiebreak_key = ""
+		if tiebreak_key != nil {
+			last_tiebreak_key = *tiebreak_key
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("Database error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	page_json, err := json.Marshal(page)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       fmt.Sprintf("JSON marshalling error: %v", err),
+			Headers: map[string]string{
+				"Content-Type": "text/plain",
+			},
+		}
+	}
+
+	headers := map[string]string{
+		"Content-Type": "application/json",
+	}
+	if next_cursor != "" {
+		headers["X-Next-Cursor"] = next_cursor
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Body:       string(page_json),
+		Headers:    headers,
+	}
+}
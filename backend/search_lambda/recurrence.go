@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/teambition/rrule-go"
+)
+
+// Range listed when the request doesn't give one
+const defaultOccurrenceRange = 7 * 24 * time.Hour
+
+const maxOccurrences = 100
+
+// Series are capped at this many occurrences on creation, walking one never
+// goes further
+const maxSeriesOccurrences = 1000
+
+type OccurrenceRet struct {
+	Start      int64  `json:"start"`
+	Stop       int64  `json:"stop"`
+	StartLocal string `json:"start_local"`
+	StopLocal  string `json:"stop_local"`
+}
+
+// Build the recurrence rule of a task, anchored at its first occurrence and
+// ending with the series. Occurrences are generated in the zone of start so
+// wall clock times stay put across daylight saving changes
+func taskRecurrence(rrule_str string, start time.Time, stop time.Time) (*rrule.RRule, error) {
+	option, err := rrule.StrToROption(rrule_str)
+	if err != nil {
+		return nil, err
+	}
+
+	option.Dtstart = start
+	if option.Until.IsZero() || option.Until.After(stop) {
+		option.Until = stop
+	}
+
+	return rrule.NewRRule(*option)
+}
+
+// Range of occurrences to expand for a listing, from the from and to
+// parameters if present
+func getOccurrenceRange(request events.APIGatewayProxyRequest) (time.Time, time.Time) {
+	from := time.Now()
+	if from_str, exists := request.QueryStringParameters["from"]; exists {
+		if from_unix, err := strconv.ParseInt(from_str, 10, 64); err == nil {
+			from = time.Unix(from_unix, 0)
+		}
+	}
+
+	to := from.Add(defaultOccurrenceRange)
+	if to_str, exists := request.QueryStringParameters["to"]; exists {
+		if to_unix, err := strconv.ParseInt(to_str, 10, 64); err == nil {
+			to = time.Unix(to_unix, 0)
+		}
+	}
+
+	return from, to
+}
+
+// Replace the series window of a recurring task with its concrete
+// occurrences overlapping [from, to]. Start and stop become the current or
+// next occurrence so clients can treat it like any other task
+func expandOccurrences(task *TaskRet, from time.Time, to time.Time) {
+	if task.RRule == "" {
+		return
+	}
+
+	location := taskLocation(task.TimeZone)
+	series_start := time.Unix(task.Start, 0).In(location)
+	series_stop := time.Unix(task.Stop, 0).In(location)
+	rule, err := taskRecurrence(task.RRule, series_start, series_stop)
+	if err != nil {
+		// Rules are validated on creation, fall back to the series window
+		return
+	}
+
+	duration := time.Duration(task.Duration) * time.Second
+	now := time.Now()
+	task.Occurrences = []OccurrenceRet{}
+	// Walk the series until the range is done and the occurrence running at
+	// now or the next one is known, falling back to the last occurrence
+	var current time.Time
+	current_found := false
+	next := rule.Iterator()
+	for i := 0; i < maxSeriesOccurrences; i++ {
+		occurrence, ok := next()
+		if !ok {
+			break
+		}
+		if !current_found {
+			current = occurrence
+			current_found = occurrence.Add(duration).After(now)
+		}
+
+		if occurrence.After(to) || len(task.Occurrences) == maxOccurrences {
+			if current_found {
+				break
+			}
+			continue
+		}
+		if occurrence.Add(duration).After(from) {
+			task.Occurrences = append(task.Occurrences, OccurrenceRet{
+				Start:      occurrence.Unix(),
+				Stop:       occurrence.Add(duration).Unix(),
+				StartLocal: formatLocalTime(occurrence.Unix(), location),
+				StopLocal:  formatLocalTime(occurrence.Add(duration).Unix(), location),
+			})
+		}
+	}
+
+	if !current.IsZero() {
+		task.Start = current.Unix()
+		task.Stop = current.Add(duration).Unix()
+		task.Status = taskStatus(current, current.Add(duration), now)
+		task.StartLocal = formatLocalTime(task.Start, location)
+		task.StopLocal = formatLocalTime(task.Stop, location)
+	}
+}
@@ -1,7 +1,7 @@
 # Create the API Gateway
 resource "aws_api_gateway_rest_api" "api_gateway" {
   name = var.api_gateway_name
-  binary_media_types = ["image/*", "application/octet-stream"] 
+  binary_media_types = ["image/*", "application/octet-stream", "application/vnd.mapbox-vector-tile", "application/x-protobuf"]
 }
 
 # Create a resource for each Lambda with its specified prefix
@@ -13,6 +13,15 @@ resource "aws_api_gateway_resource" "lambda_resource" {
   path_part   = each.value.prefix
 }
 
+# Create a catch-all child resource for Lambdas that route on the path
+resource "aws_api_gateway_resource" "proxy_resource" {
+  for_each = { for key, value in var.lambda_configs : key => value if value.greedy_path }
+
+  rest_api_id = aws_api_gateway_rest_api.api_gateway.id
+  parent_id   = aws_api_gateway_resource.lambda_resource[each.key].id
+  path_part   = "{proxy+}"
+}
+
 # Local variable to generate combinations of lambda_keys and methods
 locals {
   lambda_method_combinations = flatten([
@@ -35,7 +44,7 @@ resource "aws_api_gateway_method" "lambda_method" {
   for_each = local.lambda_method_map
 
   rest_api_id   = aws_api_gateway_rest_api.api_gateway.id
-  resource_id   = aws_api_gateway_resource.lambda_resource[each.value.lambda_key].id
+  resource_id   = var.lambda_configs[each.value.lambda_key].greedy_path ? aws_api_gateway_resource.proxy_resource[each.value.lambda_key].id : aws_api_gateway_resource.lambda_resource[each.value.lambda_key].id
   http_method   = upper(each.value.method)
   authorization = "NONE"
 }
@@ -45,7 +54,7 @@ resource "aws_api_gateway_integration" "lambda_integration" {
   for_each = local.lambda_method_map
 
   rest_api_id             = aws_api_gateway_rest_api.api_gateway.id
-  resource_id             = aws_api_gateway_resource.lambda_resource[each.value.lambda_key].id
+  resource_id             = var.lambda_configs[each.value.lambda_key].greedy_path ? aws_api_gateway_resource.proxy_resource[each.value.lambda_key].id : aws_api_gateway_resource.lambda_resource[each.value.lambda_key].id
   http_method             = upper(each.value.method)
   type                    = "AWS_PROXY"
   integration_http_method = "POST"
@@ -64,66 +73,22 @@ resource "aws_api_gateway_method" "options" {
   authorization = "NONE"
 }
 
-# Integration for OPTIONS method
+# Preflight requests go to the Lambda, which answers them for the origins
+# in its CORS_ORIGINS
 resource "aws_api_gateway_integration" "options_integration" {
   for_each = aws_api_gateway_resource.lambda_resource
 
-  rest_api_id          = aws_api_gateway_rest_api.api_gateway.id
-  resource_id          = each.value.id
-  http_method          = aws_api_gateway_method.options[each.key].http_method
-  type                 = "MOCK"
-  passthrough_behavior = "WHEN_NO_MATCH"
-
-  request_templates = {
-    "application/json" = "{\"statusCode\": 200}"
-  }
+  rest_api_id             = aws_api_gateway_rest_api.api_gateway.id
+  resource_id             = each.value.id
+  http_method             = aws_api_gateway_method.options[each.key].http_method
+  type                    = "AWS_PROXY"
+  integration_http_method = "POST"
+  uri                     = "arn:aws:apigateway:us-east-1:lambda:path/2015-03-31/functions/${var.lambda_configs[each.key].lambda_arn}/invocations"
 
   # Ensure the method exists before creating the integration
   depends_on = [aws_api_gateway_method.options]
 }
 
-# Method response for OPTIONS method
-resource "aws_api_gateway_method_response" "options_response" {
-  for_each = aws_api_gateway_resource.lambda_resource
-
-  rest_api_id = aws_api_gateway_rest_api.api_gateway.id
-  resource_id = each.value.id
-  http_method = aws_api_gateway_method.options[each.key].http_method
-  status_code = "200"
-
-  response_parameters = {
-    "method.response.header.Access-Control-Allow-Headers"     = true
-    "method.response.header.Access-Control-Allow-Methods"     = true
-    "method.response.header.Access-Control-Allow-Origin"      = true
-    "method.response.header.Access-Control-Allow-Credentials" = true
-  }
-}
-
-# Integration response for OPTIONS method
-resource "aws_api_gateway_integration_response" "options_integration_response" {
-  for_each = aws_api_gateway_resource.lambda_resource
-
-  rest_api_id = aws_api_gateway_rest_api.api_gateway.id
-  resource_id = each.value.id
-  http_method = aws_api_gateway_method.options[each.key].http_method
-  status_code = "200"
-
-  response_parameters = {
-    "method.response.header.Access-Control-Allow-Headers"     = "'Content-Type,X-Amz-Date,Authorization,X-Api-Key,X-Amz-Security-Token'"
-    "method.response.header.Access-Control-Allow-Methods"     = "'GET,POST,PUT,DELETE,OPTIONS'"
-    "method.response.header.Access-Control-Allow-Origin"      = "'*'"
-    "method.response.header.Access-Control-Allow-Credentials" = "'true'"
-  }
-
-  # Ensure both the integration and method response are created first
-  depends_on = [
-    aws_api_gateway_integration.options_integration,
-    aws_api_gateway_method_response.options_response
-  ]
-}
-
-
-
 # Give API Gateway permission to invoke the Lambda functions
 resource "aws_lambda_permission" "api_gateway_lambda" {
   for_each = var.lambda_configs
@@ -141,14 +106,15 @@ resource "aws_api_gateway_deployment" "api_deployment" {
     aws_api_gateway_integration.lambda_integration,
     aws_api_gateway_method.lambda_method,
     aws_api_gateway_integration.options_integration,
-    aws_api_gateway_method.options,
-    aws_api_gateway_integration_response.options_integration_response,
-    aws_api_gateway_method_response.options_response
+    aws_api_gateway_method.options
   ]
   rest_api_id = aws_api_gateway_rest_api.api_gateway.id
   stage_name  = "prod"
 
   triggers = {
-    redeployment = sha1(jsonencode(var.lambda_configs))
+    redeployment = sha1(jsonencode([
+      var.lambda_configs,
+      [for integration in aws_api_gateway_integration.options_integration : integration.type],
+    ]))
   }
 }
\ No newline at end of file
@@ -9,5 +9,7 @@ variable "lambda_configs" {
     lambda_arn = string
     methods    = list(string)
     prefix     = string
+    # Route every path below the prefix to the Lambda as well
+    greedy_path = optional(bool, false)
   }))
 }
\ No newline at end of file
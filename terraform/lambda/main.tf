@@ -5,6 +5,7 @@ resource "aws_lambda_function" "this" {
   runtime       = var.runtime
   architectures = [var.architecture]
   filename      = var.zip_path
+  timeout       = var.timeout
   source_code_hash = filesha256(var.zip_path)
 
   environment {
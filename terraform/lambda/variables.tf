@@ -34,4 +34,10 @@ variable "architecture" {
   type = string
   description = "Architecture to be used by Lambda"
   default = "x86_64"
+}
+
+variable "timeout" {
+  type = number
+  description = "Seconds the Lambda may run for"
+  default = 3
 }
\ No newline at end of file
@@ -91,6 +91,8 @@ module "post_lambda" {
     function_name = "post"
     zip_path = "../backend/post_lambda/getLambda.zip"
     env_vars = local.env_vars
+    # Imports geocode up to 100 rows at 5 a second
+    timeout = 30
     architecture = "arm64"
     handler = "bootstrap"
     runtime = "provided.al2"
@@ -137,5 +139,35 @@ module "api_gateway" {
             methods = ["GET"]
             prefix = "search"
         },
+        "tiles" = {
+            lambda_arn = module.get_lambda.lambda_arn
+            methods = ["GET"]
+            prefix = "tiles"
+            greedy_path = true
+        },
     }
-}
\ No newline at end of file
+}
+# Moves recurring tasks on to their next occurrence once one has ended, see
+# occurrenceRefreshInterval in backend/post_lambda/recurrence.go
+resource "aws_cloudwatch_event_rule" "refresh_occurrences" {
+  name                = "spontaniapp-refresh-occurrences"
+  schedule_expression = "rate(1 minute)"
+}
+
+resource "aws_cloudwatch_event_target" "refresh_occurrences" {
+  rule = aws_cloudwatch_event_rule.refresh_occurrences.name
+  arn  = module.post_lambda.lambda_arn
+  input = jsonencode({
+    queryStringParameters = {
+      request_type = "refresh_occurrences"
+    }
+  })
+}
+
+resource "aws_lambda_permission" "refresh_occurrences" {
+  statement_id  = "AllowRefreshOccurrencesSchedule"
+  action        = "lambda:InvokeFunction"
+  function_name = module.post_lambda.lambda_arn
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.refresh_occurrences.arn
+}